@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mjarkk/socket-talk/talkclient"
+	"github.com/mjarkk/socket-talk/talklog"
+	"github.com/mjarkk/socket-talk/talkserver"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// config is the configuration of the server
+// It's read from the yaml file of the -config flag, the other flags overwrite its values
+type config struct {
+	Listen          string        `yaml:"listen"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	KeepAlive       bool          `yaml:"keepAlive"`
+	MaxMessageSize  int64         `yaml:"maxMessageSize"`
+	Metrics         bool          `yaml:"metrics"`
+
+	TLS struct {
+		Cert string `yaml:"cert"`
+		Key  string `yaml:"key"`
+	} `yaml:"tls"`
+
+	Auth struct {
+		HandshakeKey string           `yaml:"handshakeKey"` // The key of the tokens clients connect with, see talkserver.VerifyToken
+		MessageKey   string           `yaml:"messageKey"`   // The key clients sign their messages with, see talkserver.VerifyWithKey
+		MaxAge       time.Duration    `yaml:"maxAge"`       // How old tokens and signed messages can be
+		AdminKey     string           `yaml:"adminKey"`     // Enables the routes to manage the identities
+		LinkKey      string           `yaml:"linkKey"`      // The key of the middlewares that extend this one, see talkserver.Options.LinkKey
+		Identities   []identityConfig `yaml:"identities"`   // If set clients must use one of these identities instead of the keys above
+	} `yaml:"auth"`
+
+	Upstream linkConfig `yaml:"upstream"` // The middleware this middleware extends
+
+	Cluster struct {
+		Nodes        []string `yaml:"nodes"`
+		Key          string   `yaml:"key"`      // The nodes prove to each other they are a node with this key, see talkserver.Options.ClusterKey
+		Identity     string   `yaml:"identity"` // The identity the nodes connect as, needed when the nodes have identities
+		HandshakeKey string   `yaml:"handshakeKey"`
+		MessageKey   string   `yaml:"messageKey"`
+	} `yaml:"cluster"`
+
+	Cache struct {
+		Dir          string        `yaml:"dir"` // Keeps the payloads on disk instead of in memory
+		TTL          time.Duration `yaml:"ttl"`
+		MaxEntrySize int64         `yaml:"maxEntrySize"`
+		MaxSize      int64         `yaml:"maxSize"`
+		Reads        int           `yaml:"reads"`
+	} `yaml:"cache"`
+
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"` // text or json
+	} `yaml:"log"`
+}
+
+// linkConfig is the config of a connection to another middleware
+// If Identity is set the keys are the keys of that identity in the registry of the other middleware
+type linkConfig struct {
+	URL          string `yaml:"url"`
+	Key          string `yaml:"key"` // The link key of the other middleware, see talkserver.Options.ExtendKey
+	Identity     string `yaml:"identity"`
+	HandshakeKey string `yaml:"handshakeKey"`
+	MessageKey   string `yaml:"messageKey"`
+}
+
+// auth returns the functions to create the token and sign the messages of the connection
+func (l linkConfig) auth() (token func() (string, error), sign func([]byte) []byte) {
+	if l.HandshakeKey != "" {
+		if l.Identity != "" {
+			token = talkclient.TokenAsIdentity(l.Identity, l.HandshakeKey)
+		} else {
+			token = talkclient.TokenWithKey(l.HandshakeKey)
+		}
+	}
+	if l.MessageKey != "" {
+		if l.Identity != "" {
+			sign = talkclient.SignAsIdentity(l.Identity, l.MessageKey)
+		} else {
+			sign = talkclient.SignWithKey(l.MessageKey)
+		}
+	}
+	return token, sign
+}
+
+// identityConfig is an identity of the registry
+// The titles of the rules are the plain titles, they are hashed when the config is loaded
+type identityConfig struct {
+	Name      string    `yaml:"name"`
+	Key       string    `yaml:"key"`
+	Publish   aclConfig `yaml:"publish"`
+	Subscribe aclConfig `yaml:"subscribe"`
+}
+
+type aclConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// listFlag is a flag with a comma separated list
+type listFlag struct {
+	list *[]string
+}
+
+func (f listFlag) String() string {
+	if f.list == nil {
+		return ""
+	}
+	return strings.Join(*f.list, ",")
+}
+
+func (f listFlag) Set(value string) error {
+	*f.list = []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			*f.list = append(*f.list, item)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads the config from the config file and the flags
+func loadConfig(args []string) (*config, error) {
+	c := &config{}
+	flags := flag.NewFlagSet("socket-talk-server", flag.ContinueOnError)
+
+	configFile := flags.String("config", "", "path to a yaml config file, flags overwrite its values")
+	flags.StringVar(&c.Listen, "listen", ":9090", "address to listen on")
+	flags.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", time.Second*10, "how long to wait for open requests on shutdown")
+	flags.BoolVar(&c.KeepAlive, "keep-alive", false, "send a keep alive message to the clients every 30 seconds")
+	flags.Int64Var(&c.MaxMessageSize, "max-message-size", 0, "max size in bytes of a websocket message (default 65536)")
+	flags.BoolVar(&c.Metrics, "metrics", false, "serve prometheus metrics on /socketTalk/metrics")
+	flags.StringVar(&c.TLS.Cert, "tls-cert", "", "path to the TLS certificate, enables https")
+	flags.StringVar(&c.TLS.Key, "tls-key", "", "path to the TLS key")
+	flags.StringVar(&c.Auth.HandshakeKey, "handshake-key", "", "key of the tokens clients must connect with")
+	flags.StringVar(&c.Auth.MessageKey, "message-key", "", "key clients must sign their messages with")
+	flags.DurationVar(&c.Auth.MaxAge, "auth-max-age", 0, "how old tokens and signed messages can be (default 30s)")
+	flags.StringVar(&c.Auth.AdminKey, "admin-key", "", "key of the routes to manage the identities, needs identities in the config file")
+	flags.StringVar(&c.Auth.LinkKey, "link-key", "", "key of the middlewares that extend this middleware")
+	flags.StringVar(&c.Upstream.URL, "upstream", "", "url of the middleware this middleware extends")
+	flags.StringVar(&c.Upstream.Key, "upstream-key", "", "link key of the upstream middleware")
+	flags.StringVar(&c.Upstream.Identity, "upstream-identity", "", "identity to connect to the upstream middleware as, the upstream keys are its keys")
+	flags.StringVar(&c.Upstream.HandshakeKey, "upstream-handshake-key", "", "handshake key of the upstream middleware")
+	flags.StringVar(&c.Upstream.MessageKey, "upstream-message-key", "", "message key of the upstream middleware")
+	flags.Var(listFlag{&c.Cluster.Nodes}, "cluster", "comma separated urls of the nodes of the cluster")
+	flags.StringVar(&c.Cluster.Key, "cluster-key", "", "key the cluster nodes prove they are a node with, needed with -cluster")
+	flags.StringVar(&c.Cluster.Identity, "cluster-identity", "", "identity the cluster nodes connect as, the cluster keys are its keys")
+	flags.StringVar(&c.Cluster.HandshakeKey, "cluster-handshake-key", "", "handshake key of the cluster nodes")
+	flags.StringVar(&c.Cluster.MessageKey, "cluster-message-key", "", "message key of the cluster nodes")
+	flags.StringVar(&c.Cache.Dir, "cache-dir", "", "keep the payloads in this directory instead of in memory")
+	flags.DurationVar(&c.Cache.TTL, "cache-ttl", 0, "how long a payload is kept (default 20s)")
+	flags.Int64Var(&c.Cache.MaxEntrySize, "max-cache-entry-size", 0, "max size in bytes of a payload, 0 means no limit")
+	flags.Int64Var(&c.Cache.MaxSize, "max-cache-size", 0, "max size in bytes of all payloads together, 0 means no limit")
+	flags.IntVar(&c.Cache.Reads, "cache-reads", 0, "times a payload can be fetched before it's removed, 0 means no limit")
+	flags.StringVar(&c.Log.Level, "log-level", "info", "debug, info, warn or error")
+	flags.StringVar(&c.Log.Format, "log-format", "text", "text or json")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if *configFile == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.UnmarshalStrict(data, c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the flags again so they overwrite the values of the config file
+	err = flags.Parse(args)
+	return c, err
+}
+
+// logger creates the logger of the log config
+func (c *config) logger() (talklog.Logger, error) {
+	level, err := talklog.ParseLevel(c.Log.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Log.Format {
+	case "text", "":
+		return talklog.NewStdLogger(log.New(os.Stdout, "", log.LstdFlags), level), nil
+	case "json":
+		return talklog.NewJSONLogger(os.Stdout, level), nil
+	default:
+		return nil, errors.New("Unknown log format " + c.Log.Format + ", use text or json")
+	}
+}
+
+// options converts the config to the options of the middleware
+func (c *config) options() (talkserver.Options, error) {
+	logger, err := c.logger()
+	if err != nil {
+		return talkserver.Options{}, err
+	}
+
+	o := talkserver.Options{
+		SendKeepAlive:     c.KeepAlive,
+		MaxMessageSize:    c.MaxMessageSize,
+		Metrics:           c.Metrics,
+		Logger:            logger,
+		ExtendURL:         c.Upstream.URL,
+		ExtendKey:         c.Upstream.Key,
+		LinkKey:           c.Auth.LinkKey,
+		Cluster:           c.Cluster.Nodes,
+		ClusterKey:        c.Cluster.Key,
+		CacheTTL:          c.Cache.TTL,
+		MaxCacheEntrySize: c.Cache.MaxEntrySize,
+		MaxCacheSize:      c.Cache.MaxSize,
+		CacheReads:        c.Cache.Reads,
+	}
+
+	if len(c.Cluster.Nodes) > 0 && c.Cluster.Key == "" {
+		return o, errors.New("The cluster nodes need a cluster key")
+	}
+
+	if c.Cache.Dir != "" {
+		store, err := talkserver.NewDiskStore(c.Cache.Dir)
+		if err != nil {
+			return o, err
+		}
+		o.Store = store
+	}
+
+	if len(c.Auth.Identities) > 0 {
+		registry := talkserver.NewRegistry(c.Auth.MaxAge)
+		for _, identity := range c.Auth.Identities {
+			err = registry.Set(talkserver.Identity{
+				Name:      identity.Name,
+				Key:       identity.Key,
+				Publish:   identity.Publish.acl(),
+				Subscribe: identity.Subscribe.acl(),
+			})
+			if err != nil {
+				return o, err
+			}
+		}
+		o.Registry = registry
+		o.HandshakeAuth = registry.VerifyToken
+		o.AdminKey = c.Auth.AdminKey
+	} else {
+		if c.Auth.AdminKey != "" {
+			return o, errors.New("The admin key needs identities in the config file")
+		}
+		if c.Auth.HandshakeKey != "" {
+			o.HandshakeAuth = talkserver.VerifyToken(c.Auth.HandshakeKey, c.Auth.MaxAge)
+		}
+		if c.Auth.MessageKey != "" {
+			o.Auth = talkserver.VerifyWithKey(c.Auth.MessageKey, c.Auth.MaxAge)
+		}
+	}
+
+	cluster := linkConfig{
+		Identity:     c.Cluster.Identity,
+		HandshakeKey: c.Cluster.HandshakeKey,
+		MessageKey:   c.Cluster.MessageKey,
+	}
+	if len(c.Cluster.Nodes) > 0 && len(c.Auth.Identities) > 0 {
+		// The nodes use the same config, they only accept each other with one of the identities
+		if cluster.Identity == "" || cluster.HandshakeKey == "" || cluster.MessageKey == "" {
+			return o, errors.New("The cluster nodes need an identity with its handshake and message key when identities are used")
+		}
+		if _, ok := o.Registry.Get(cluster.Identity); !ok {
+			return o, errors.New("The cluster identity " + cluster.Identity + " is not one of the identities")
+		}
+	}
+	for _, l := range []linkConfig{c.Upstream, cluster} {
+		if l.Identity != "" && l.HandshakeKey == "" && l.MessageKey == "" {
+			return o, errors.New("The identity " + l.Identity + " needs a handshake or message key")
+		}
+	}
+
+	o.ExtendToken, o.ExtendAuth = c.Upstream.auth()
+	o.ClusterToken, o.ClusterAuth = cluster.auth()
+
+	return o, nil
+}
+
+// acl converts the plain titles of the rules to the hashed titles the middleware uses
+func (a aclConfig) acl() talkserver.ACL {
+	acl := talkserver.ACL{}
+	for _, title := range a.Allow {
+		acl.Allow = append(acl.Allow, talkserver.HashTitle(title))
+	}
+	for _, title := range a.Deny {
+		acl.Deny = append(acl.Deny, talkserver.HashTitle(title))
+	}
+	return acl
+}
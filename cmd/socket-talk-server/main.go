@@ -0,0 +1,84 @@
+// Command socket-talk-server runs a socket talk middleware
+//
+// Configure it with flags or a yaml config file, see config.example.yaml and socket-talk-server -help
+//
+//	socket-talk-server -listen :9090 -handshake-key "my key"
+//	socket-talk-server -config config.yaml
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mjarkk/socket-talk/talklog"
+	"github.com/mjarkk/socket-talk/talkserver"
+)
+
+func main() {
+	err := run(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "socket-talk-server:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	c, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("Both the TLS cert and key are needed")
+	}
+
+	options, err := c.options()
+	if err != nil {
+		return err
+	}
+	logger := options.Logger
+
+	talk := talkserver.New(options)
+	if store, ok := options.Store.(*talkserver.DiskStore); ok {
+		// The middleware only closes the store it created itself
+		defer store.Close()
+	}
+	server := &http.Server{
+		Addr:    c.Listen,
+		Handler: talk,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Log(talklog.LevelInfo, "Listening", talklog.F("address", c.Listen), talklog.F("tls", c.TLS.Cert != ""))
+		if c.TLS.Cert != "" {
+			serveErr <- server.ListenAndServeTLS(c.TLS.Cert, c.TLS.Key)
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
+		talk.Close()
+		return err
+	case sig := <-stop:
+		logger.Log(talklog.LevelInfo, "Shutting down", talklog.F("signal", sig.String()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	talk.Close()
+	return err
+}
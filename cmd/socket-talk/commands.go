@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mjarkk/socket-talk/talkclient"
+)
+
+// jsonArg checks if value is valid json so it can be send as is
+func jsonArg(value string) (json.RawMessage, error) {
+	if !json.Valid([]byte(value)) {
+		return nil, usageErr{fmt.Errorf("%q is not valid json, quote strings like '\"text\"'", value)}
+	}
+	return json.RawMessage(value), nil
+}
+
+// pub sends a message
+func (c *cli) pub(args []string) error {
+	flags := c.flagSet("socket-talk pub")
+	args, err := parse(flags, args, "title", "json")
+	if err != nil {
+		return err
+	}
+	data, err := jsonArg(args[1])
+	if err != nil {
+		return err
+	}
+
+	client, _, err := c.connect(c.options())
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	err = client.SendCtx(ctx, args[0], data)
+	if err == context.DeadlineExceeded {
+		return errTimeout
+	}
+	return err
+}
+
+// req sends a message and prints the answer
+func (c *cli) req(args []string) error {
+	flags := c.flagSet("socket-talk req")
+	args, err := parse(flags, args, "title", "json")
+	if err != nil {
+		return err
+	}
+	data, err := jsonArg(args[1])
+	if err != nil {
+		return err
+	}
+
+	client, _, err := c.connect(c.options())
+	if err != nil {
+		return err
+	}
+	defer client.Disconnect(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	var answer json.RawMessage
+	err = client.SendAndReceiveCtx(ctx, args[0], data, &answer)
+	if err == context.DeadlineExceeded {
+		return errTimeout
+	} else if err != nil {
+		return err
+	}
+	fmt.Println(string(answer))
+	return nil
+}
+
+// sub prints the payloads of the incoming messages until the command is stopped or the connection is lost
+func (c *cli) sub(args []string) error {
+	flags := c.flagSet("socket-talk sub")
+	group := flags.String("group", "", "subscribe as member of a queue group")
+	answerFile := flags.String("answer", "", "answer messages that expect an answer with the json in this file")
+	args, err := parse(flags, args, "title")
+	if err != nil {
+		return err
+	}
+
+	var answer json.RawMessage
+	if *answerFile != "" {
+		data, err := ioutil.ReadFile(*answerFile)
+		if err != nil {
+			return err
+		}
+		answer, err = jsonArg(string(data))
+		if err != nil {
+			return err
+		}
+	}
+
+	client, disconnected, err := c.connect(c.options())
+	if err != nil {
+		return err
+	}
+
+	client.SubscribeQueue(args[0], *group, func(msg *talkclient.WSMessage) {
+		if msg.Err != nil {
+			fmt.Fprintln(os.Stderr, "socket-talk:", msg.Err)
+			return
+		}
+		fmt.Println(string(msg.Bytes))
+
+		if msg.ExpectsAnswer && answer != nil {
+			msg.Aswer(answer)
+		}
+	})
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case <-stop:
+		client.Disconnect(nil)
+		return nil
+	case err := <-disconnected:
+		return err
+	}
+}
@@ -0,0 +1,228 @@
+// Command socket-talk publishes, subscribes and sends requests to a socket talk middleware from the terminal
+//
+//	socket-talk [flags] pub [flags] <title> <json>
+//	socket-talk [flags] sub [flags] <title>
+//	socket-talk [flags] req [flags] <title> <json>
+//
+// The exit status is 0 on success, 1 on an error, 2 on wrong usage, 3 on a timeout and 4 if the authentication failed
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mjarkk/socket-talk/talkclient"
+	"github.com/mjarkk/socket-talk/talklog"
+)
+
+// The exit statuses of the command
+const (
+	exitOK         = 0
+	exitError      = 1
+	exitUsage      = 2
+	exitTimeout    = 3
+	exitAuthFailed = 4
+)
+
+// errTimeout is returned when the middleware or the receivers don't respond in time
+var errTimeout = errors.New("Timeout, no response within the time set with -timeout")
+
+const usage = `Usage:
+  socket-talk [flags] pub [flags] <title> <json>   send a message
+  socket-talk [flags] sub [flags] <title>          print the payloads of incoming messages
+  socket-talk [flags] req [flags] <title> <json>   send a message and print the answer
+
+Flags can be set before or after the command, see socket-talk <command> -help`
+
+// cli contains the flags shared by all commands
+type cli struct {
+	server   string
+	key      string
+	identity string
+	noProxy  bool
+	timeout  time.Duration
+	verbose  bool
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	c := &cli{
+		server:  envOr("SOCKET_TALK_SERVER", "http://localhost:9090"),
+		key:     os.Getenv("SOCKET_TALK_KEY"),
+		timeout: time.Second * 10,
+	}
+	flags := c.flagSet("socket-talk")
+	err := flags.Parse(args)
+	if err != nil {
+		return usageError(err)
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return exitUsage
+	}
+
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "pub":
+		err = c.pub(args)
+	case "sub":
+		err = c.sub(args)
+	case "req":
+		err = c.req(args)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown command "+command+"\n\n"+usage)
+		return exitUsage
+	}
+	return exitStatus(err)
+}
+
+// usageErr is returned when the command is used the wrong way
+type usageErr struct {
+	err error
+}
+
+func (e usageErr) Error() string {
+	if e.err == nil {
+		return "Wrong usage"
+	}
+	return e.err.Error()
+}
+
+// usageError prints the error of a flag set and returns the exit status for it
+func usageError(err error) int {
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+	// The flag set already printed the error
+	return exitUsage
+}
+
+// exitStatus prints err and returns the exit status for it
+func exitStatus(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if err == flag.ErrHelp {
+		return exitOK
+	}
+
+	if usage, ok := err.(usageErr); ok {
+		if usage.err != nil {
+			fmt.Fprintln(os.Stderr, "socket-talk:", usage.err)
+		}
+		return exitUsage
+	}
+
+	fmt.Fprintln(os.Stderr, "socket-talk:", err)
+	switch err {
+	case talkclient.ErrAuthFailed:
+		return exitAuthFailed
+	case errTimeout:
+		return exitTimeout
+	default:
+		return exitError
+	}
+}
+
+// flagSet creates a flag set with the shared flags
+// The current values are used as defaults so the flags of a command don't reset the flags set before the command
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&c.server, "server", c.server, "url of the middleware, env: SOCKET_TALK_SERVER")
+	flags.Var(secretFlag{&c.key}, "key", "the `key` to create the connection tokens and sign the messages with, env: SOCKET_TALK_KEY")
+	flags.StringVar(&c.identity, "identity", c.identity, "identity of the registry the key belongs to")
+	flags.BoolVar(&c.noProxy, "no-proxy", c.noProxy, "don't use the proxy settings of the environment")
+	flags.DurationVar(&c.timeout, "timeout", c.timeout, "how long to wait for the connection and answers")
+	flags.BoolVar(&c.verbose, "verbose", c.verbose, "log the connection and messages to stderr")
+	return flags
+}
+
+// secretFlag is a string flag that doesn't show its value in the help
+type secretFlag struct {
+	value *string
+}
+
+func (f secretFlag) String() string {
+	return ""
+}
+
+func (f secretFlag) Set(value string) error {
+	*f.value = value
+	return nil
+}
+
+// parse parses the flags of a command and checks the amount of arguments
+func parse(flags *flag.FlagSet, args []string, names ...string) ([]string, error) {
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		return nil, err
+	} else if err != nil {
+		// The flag set already printed the error
+		return nil, usageErr{}
+	}
+	if flags.NArg() != len(names) {
+		return nil, usageErr{fmt.Errorf("%s needs %d arguments: %v", flags.Name(), len(names), names)}
+	}
+	return flags.Args(), nil
+}
+
+func envOr(key string, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// options returns the client options of the flags
+func (c *cli) options() talkclient.Options {
+	o := talkclient.Options{
+		ServerURL: c.server,
+		NoProxy:   c.noProxy,
+		Logger:    talklog.Nop,
+	}
+	if c.verbose {
+		o.Logger = talklog.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), talklog.LevelDebug)
+	}
+
+	if c.key != "" {
+		if c.identity != "" {
+			o.Token = talkclient.TokenAsIdentity(c.identity, c.key)
+			o.Auth = talkclient.SignAsIdentity(c.identity, c.key)
+		} else {
+			o.Token = talkclient.TokenWithKey(c.key)
+			o.Auth = talkclient.SignWithKey(c.key)
+		}
+	}
+	return o
+}
+
+// connect creates a client and waits until it's connected
+// The returned channel receives the reason when the connection is lost
+func (c *cli) connect(o talkclient.Options) (*talkclient.Client, <-chan error, error) {
+	client, err := talkclient.NewClient(o)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	disconnected := make(chan error, 1)
+	go func() {
+		disconnected <- client.Connect()
+	}()
+
+	select {
+	case <-client.ConnectChan:
+		return client, disconnected, nil
+	case err := <-disconnected:
+		return nil, nil, err
+	case <-time.After(c.timeout):
+		return nil, nil, errTimeout
+	}
+}
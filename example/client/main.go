@@ -6,7 +6,6 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/mjarkk/socket-talk/talkclient"
 )
@@ -35,16 +34,11 @@ func setupClient1() {
 		os.Exit(1)
 	}
 
-	go func() {
-		for {
-			err := c.Connect()
-			if err == nil {
-				break
-			}
-			fmt.Println("ERROR:", err)
-			time.Sleep(time.Second * 3)
-		}
-	}()
+	err = c.Start()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
 
 	<-c.ConnectChan
 
@@ -75,16 +69,11 @@ func setupClient2() {
 		os.Exit(1)
 	}
 
-	go func() {
-		for {
-			err := c.Connect()
-			if err == nil {
-				break
-			}
-			fmt.Println("ERROR:", err)
-			time.Sleep(time.Second * 3)
-		}
-	}()
+	err = c.Start()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
 
 	<-c.ConnectChan
 
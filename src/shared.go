@@ -14,10 +14,71 @@ func Hash(in string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// SubscribeTitle is the title of the message a client sends to tell the server what hashed titles it wants to receive
+var SubscribeTitle = Hash("SOCKET_TALK_SUBSCRIBE")
+
+// UnsubscribeTitle is the title of the message a client sends when it no longer wants to receive some hashed titles
+var UnsubscribeTitle = Hash("SOCKET_TALK_UNSUBSCRIBE")
+
+// AuthFailedTitle is the title of the message the server sends back when a message failed the authentication
+var AuthFailedTitle = Hash("SOCKET_TALK_AUTH_FAILED")
+
+// HelloTitle is the title of the message a client sends after connecting to tell the server who it is
+var HelloTitle = Hash("SOCKET_TALK_HELLO")
+
+// PeersTitle is the title of the message a client sends to ask the server for the connected clients
+// The server answers with a message with the same title and ID that contains the peers
+var PeersTitle = Hash("SOCKET_TALK_PEERS")
+
+// PeerJoinedTitle is the title of the message the server sends when a client said hello
+var PeerJoinedTitle = Hash("SOCKET_TALK_PEER_JOINED")
+
+// PeerLeftTitle is the title of the message the server sends when a client that said hello disconnected
+var PeerLeftTitle = Hash("SOCKET_TALK_PEER_LEFT")
+
+// DeliveredTitle is the title of the message the server sends back when a direct message was delivered
+// The ID is the ID of the direct message
+var DeliveredTitle = Hash("SOCKET_TALK_DELIVERED")
+
+// NotConnectedTitle is the title of the message the server sends back when the receiver of a direct message is not connected
+// The ID is the ID of the direct message
+var NotConnectedTitle = Hash("SOCKET_TALK_NOT_CONNECTED")
+
+// Peer describes a client connected to the server
+type Peer struct {
+	ID          string            `json:"ID"`               // The instance ID of the client
+	Name        string            `json:"name,omitempty"`   // The name of the service the client belongs to
+	Labels      map[string]string `json:"labels,omitempty"` // Extra information about the client like a version or region
+	ConnectedAt int64             `json:"connectedAt"`      // Unix time in seconds of when the server received the hello, set by the server
+}
+
 // SendMeta is the data that gets send over the websocket
 type SendMeta struct {
-	Title         string `json:"title"`
-	ID            string `json:"ID"`
-	MessageID     string `json:"messageID"`
-	ExpectsAnswer bool   `json:"expectsAnswer"`
+	Title         string   `json:"title"`
+	ID            string   `json:"ID"`
+	From          string   `json:"from,omitempty"` // The ID of the client that send the message
+	To            string   `json:"to,omitempty"`   // The ID of the only client that should receive the message, empty for a broadcast
+	MessageID     string   `json:"messageID"`
+	Payload       []byte   `json:"payload,omitempty"` // The payload if it was small enough to send inline, if set MessageID is empty
+	ExpectsAnswer bool     `json:"expectsAnswer"`
+	NeedsAck      bool     `json:"needsAck,omitempty"`  // The receivers should send an empty answer as soon as they handled the message
+	Topics        []string `json:"topics,omitempty"`    // The hashed titles of a subscribe or unsubscribe message
+	Group         string   `json:"group,omitempty"`     // The queue group of a subscribe or unsubscribe message or the group a message was delivered to
+	Peer          *Peer    `json:"peer,omitempty"`      // The client of a hello, peer joined or peer left message
+	Peers         []Peer   `json:"peers,omitempty"`     // The answer to a peers message
+	TitleHint     string   `json:"titleHint,omitempty"` // The plain title, only set by senders that enabled title hints for debugging
+
+	ReplyTo string `json:"replyTo,omitempty"` // The title of the message this message answers or the subscription wants the answers of
+
+	// These fields are set by middlewares that forward the message to the middleware they extend
+	Origin string   `json:"origin,omitempty"` // The ID of the middleware the message was forwarded from first
+	Frame  uint64   `json:"frame,omitempty"`  // The number the origin gave this transmission of the message, a re-send gets a new number
+	Hops   int      `json:"hops,omitempty"`   // The amount of times the message was forwarded to another middleware
+	Served []string `json:"served,omitempty"` // The queue groups a member already received the message of, the middleware it's forwarded to skips them
+
+	// These fields are only set when the message is signed
+	Identity  string `json:"identity,omitempty"`  // The name of the identity the message is signed by, see talkserver.Registry
+	Timestamp int64  `json:"timestamp,omitempty"` // Unix time in nanoseconds of when the message was signed
+	Nonce     string `json:"nonce,omitempty"`     // A random string that is only used once
+	Signature string `json:"signature,omitempty"` // The hmac over all other fields except Origin, Frame, Hops and Served, see Sign
 }
@@ -0,0 +1,38 @@
+package src
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// Sign returns the hmac of meta signed with key
+// The hmac is created using sha3-256 over the json of meta without the Signature field
+// Origin, Frame, Hops and Served are left out as middlewares change them while forwarding the message
+func Sign(key []byte, meta SendMeta) (string, error) {
+	meta.Signature = ""
+	meta.Origin = ""
+	meta.Frame = 0
+	meta.Hops = 0
+	meta.Served = nil
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha3.New256, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// ValidSignature checks if the Signature field of meta matches the hmac of the rest of meta
+func ValidSignature(key []byte, meta SendMeta) bool {
+	expected, err := Sign(key, meta)
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal([]byte(expected), []byte(meta.Signature))
+}
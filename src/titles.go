@@ -0,0 +1,114 @@
+package src
+
+import (
+	"strings"
+)
+
+const (
+	// TitleSeparator separates the levels of a hierarchical title like "orders.created"
+	TitleSeparator = "."
+	// SingleWildcard matches exactly one level of a title, "orders.*" matches "orders.created" but not "orders.created.eu"
+	SingleWildcard = "*"
+	// MultiWildcard matches one or more levels of a title and can only be used as last level,
+	// "metrics.>" matches "metrics.cpu" and "metrics.cpu.core1"
+	MultiWildcard = ">"
+)
+
+// HashTitle hashes every level of a title separately so the server can match wildcards without knowing the real title
+// Wildcards are not hashed
+// A title without levels results in the same as Hash(title)
+func HashTitle(title string) string {
+	levels := strings.Split(title, TitleSeparator)
+	for i, level := range levels {
+		if level != SingleWildcard && level != MultiWildcard {
+			levels[i] = Hash(level)
+		}
+	}
+	return strings.Join(levels, TitleSeparator)
+}
+
+// HasWildcard returns true if one of the levels of title is a wildcard
+func HasWildcard(title string) bool {
+	for _, level := range strings.Split(title, TitleSeparator) {
+		if level == SingleWildcard || level == MultiWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTitle returns true if title matches pattern
+// Both must be hashed the same way, so both hashed with HashTitle or both plain text
+func MatchTitle(pattern, title string) bool {
+	if pattern == title {
+		return true
+	}
+
+	patternLevels := strings.Split(pattern, TitleSeparator)
+	titleLevels := strings.Split(title, TitleSeparator)
+	for i, level := range patternLevels {
+		if level == MultiWildcard {
+			return i == len(patternLevels)-1 && len(titleLevels) > i
+		}
+		if i >= len(titleLevels) {
+			return false
+		}
+		if level != SingleWildcard && level != titleLevels[i] {
+			return false
+		}
+	}
+	return len(patternLevels) == len(titleLevels)
+}
+
+// OverlapTitles returns true if there is a title that matches both a and b
+// Both can contain wildcards, for titles without wildcards this is the same as MatchTitle
+func OverlapTitles(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	aLevels := strings.Split(a, TitleSeparator)
+	bLevels := strings.Split(b, TitleSeparator)
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		aLevel, bLevel := aLevels[i], bLevels[i]
+		if aLevel == MultiWildcard || bLevel == MultiWildcard {
+			// The multi level wildcard matches all levels that are left of the other title
+			return true
+		}
+		if aLevel != SingleWildcard && bLevel != SingleWildcard && aLevel != bLevel {
+			return false
+		}
+	}
+	return len(aLevels) == len(bLevels)
+}
+
+// CoverTitle returns true if pattern matches every title that title matches
+// title can contain wildcards, for a title without wildcards this is the same as MatchTitle
+func CoverTitle(pattern, title string) bool {
+	if pattern == title {
+		return true
+	}
+
+	patternLevels := strings.Split(pattern, TitleSeparator)
+	titleLevels := strings.Split(title, TitleSeparator)
+	for i, level := range titleLevels {
+		if i >= len(patternLevels) {
+			return false
+		}
+		patternLevel := patternLevels[i]
+		if patternLevel == MultiWildcard {
+			return i == len(patternLevels)-1
+		}
+		if level == MultiWildcard {
+			// Only the multi level wildcard matches a varying amount of levels
+			return false
+		}
+		if patternLevel == SingleWildcard {
+			continue
+		}
+		if level == SingleWildcard || level != patternLevel {
+			return false
+		}
+	}
+	return len(patternLevels) == len(titleLevels)
+}
@@ -0,0 +1,101 @@
+package src
+
+import "testing"
+
+func TestMatchTitle(t *testing.T) {
+	tests := []struct {
+		pattern string
+		title   string
+		match   bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "invoices", false},
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders", false},
+		{"orders", "orders.created", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.created.eu", false},
+		{"orders.*", "orders", false},
+		{"*.created", "orders.created", true},
+		{"*.created", "orders.deleted", false},
+		{"orders.>", "orders.created", true},
+		{"orders.>", "orders.created.eu", true},
+		{"orders.>", "orders", false},
+		{">", "orders", true},
+		{">", "orders.created", true},
+		{"orders.>.eu", "orders.created.eu", false},
+		{"*.*", "orders.created", true},
+		{"*.*", "orders", false},
+	}
+
+	for _, test := range tests {
+		if match := MatchTitle(test.pattern, test.title); match != test.match {
+			t.Errorf("MatchTitle(%q, %q) = %v, expected %v", test.pattern, test.title, match, test.match)
+		}
+	}
+}
+
+func TestOverlapTitles(t *testing.T) {
+	tests := []struct {
+		a       string
+		b       string
+		overlap bool
+	}{
+		{"admin.secrets", "admin.secrets", true},
+		{"admin.secrets", "admin.users", false},
+		{"admin.secrets", "admin.*", true},
+		{"admin.secrets", "admin.>", true},
+		{"admin.secrets", "*.*", true},
+		{"admin.secrets", "*", false},
+		{"admin.secrets", ">", true},
+		{"admin.>", ">", true},
+		{"admin.>", "*.x", true},
+		{"admin.>", "admin", false},
+		{"admin.>", "orders.*", false},
+		{"admin.*", "*.secrets", true},
+		{"admin.*", "*.*.*", false},
+		{"*.*", "admin.secrets.keys", false},
+	}
+
+	for _, test := range tests {
+		if overlap := OverlapTitles(test.a, test.b); overlap != test.overlap {
+			t.Errorf("OverlapTitles(%q, %q) = %v, expected %v", test.a, test.b, overlap, test.overlap)
+		}
+		if overlap := OverlapTitles(test.b, test.a); overlap != test.overlap {
+			t.Errorf("OverlapTitles(%q, %q) = %v, expected %v", test.b, test.a, overlap, test.overlap)
+		}
+	}
+}
+
+func TestCoverTitle(t *testing.T) {
+	tests := []struct {
+		pattern string
+		title   string
+		cover   bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.*", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders.*", true},
+		{"orders.*", "orders.>", false},
+		{"orders.*", "*.created", false},
+		{"orders.>", "orders.created", true},
+		{"orders.>", "orders.*", true},
+		{"orders.>", "orders.*.eu", true},
+		{"orders.>", "orders.>", true},
+		{"orders.>", "orders", false},
+		{"orders.>", ">", false},
+		{"orders.>", "*.created", false},
+		{">", ">", true},
+		{">", "*.*", true},
+		{"*", ">", false},
+		{"*.*", "orders.*", true},
+		{"*.*", "orders", false},
+	}
+
+	for _, test := range tests {
+		if cover := CoverTitle(test.pattern, test.title); cover != test.cover {
+			t.Errorf("CoverTitle(%q, %q) = %v, expected %v", test.pattern, test.title, cover, test.cover)
+		}
+	}
+}
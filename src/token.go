@@ -0,0 +1,62 @@
+package src
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// NewToken creates a token to authenticate a connection
+// The token contains the identity, the time it was created and a hmac over both signed with key
+// identity can be empty when all clients share the same key
+func NewToken(identity string, key []byte, now time.Time) string {
+	encodedIdentity := base64.RawURLEncoding.EncodeToString([]byte(identity))
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return encodedIdentity + "." + timestamp + "." + tokenSignature(key, encodedIdentity, timestamp)
+}
+
+// VerifyToken checks a token created by NewToken
+// keyFor returns the key of an identity, tokens older than maxAge are rejected
+// Returns the identity of the token
+func VerifyToken(token string, keyFor func(identity string) ([]byte, bool), maxAge time.Duration) (string, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	identity, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+
+	unix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > maxAge || age < -maxAge {
+		return "", false
+	}
+
+	key, ok := keyFor(string(identity))
+	if !ok {
+		return "", false
+	}
+
+	expected := tokenSignature(key, parts[0], parts[1])
+	if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+		return "", false
+	}
+	return string(identity), true
+}
+
+func tokenSignature(key []byte, encodedIdentity string, timestamp string) string {
+	mac := hmac.New(sha3.New256, key)
+	mac.Write([]byte(encodedIdentity + "." + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -6,6 +6,9 @@ import (
 
 // AuthWithKey returns a handeler for Options.Auth
 // If key is empty this function will panic
+//
+// Deprecated: every message contains the same prefix so a captured message can be replayed,
+// use SignWithKey together with talkserver.VerifyWithKey instead
 func AuthWithKey(key string) func([]byte) []byte {
 	if key == "" {
 		panic("AuthWithKey key is empty")
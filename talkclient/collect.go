@@ -0,0 +1,99 @@
+package talkclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrNoQuorum is returned by SendAndCollect when less answers than CollectOptions.Quorum were received in time
+var ErrNoQuorum = errors.New("Not enough answers received")
+
+// maxCollectAnswers is the max amount of answers SendAndCollect can receive
+const maxCollectAnswers = 1024
+
+// CollectOptions are the options for SendAndCollect
+type CollectOptions struct {
+	// Timeout is how long to wait for answers, default: 5 seconds
+	Timeout time.Duration
+	// Count is the expected amount of answers, when this amount is received SendAndCollect returns directly
+	// 0 means wait for answers until the timeout
+	Count int
+	// Quorum is the minimal amount of answers needed, if less answers are received before the timeout ErrNoQuorum is returned
+	// If Count is not set SendAndCollect returns directly when the quorum is reached
+	Quorum int
+}
+
+// Response is an answer received by SendAndCollect
+type Response struct {
+	From  string // The ID of the client that send the answer
+	Bytes []byte // The actual answer
+	Err   error  // Err is set when the answer couldn't be read, for example ErrDecryptionFailed
+}
+
+// BindJSON binds the json data of the answer to v, this is the same as json.Unmarshal
+func (r Response) BindJSON(v interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return json.Unmarshal(r.Bytes, v)
+}
+
+// SendAndCollect sends something into the network and collects the answers of everyone that responds
+// Use this for things like health checks where more than one client answers
+func (c *Client) SendAndCollect(title string, data interface{}, options CollectOptions) ([]Response, error) {
+	return c.SendAndCollectCtx(context.Background(), title, data, options)
+}
+
+// SendAndCollectCtx is the same as SendAndCollect but also stops when ctx ends
+// If ctx is canceled the answers received so far are returned together with ctx.Err()
+func (c *Client) SendAndCollectCtx(ctx context.Context, title string, data interface{}, options CollectOptions) ([]Response, error) {
+	if options.Timeout == 0 {
+		options.Timeout = time.Second * 5
+	}
+	stopAt := options.Count
+	if stopAt == 0 {
+		stopAt = options.Quorum
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+
+	request, done, err := publish(ctx, sendOptions{
+		C:             c,
+		Title:         title,
+		ExpectsAnswer: true,
+		MaxAnswers:    maxCollectAnswers,
+		Data:          data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	responses := []Response{}
+	for stopAt == 0 || len(responses) < stopAt {
+		select {
+		case answer := <-request.answer:
+			if answer.Err == ErrAuthFailed {
+				return responses, answer.Err
+			}
+			responses = append(responses, Response{
+				From:  answer.From,
+				Bytes: answer.Bytes,
+				Err:   answer.Err,
+			})
+		case <-ctx.Done():
+			if ctx.Err() == context.Canceled {
+				return responses, ctx.Err()
+			}
+			if len(responses) < options.Quorum {
+				return responses, ErrNoQuorum
+			}
+			return responses, nil
+		}
+	}
+
+	return responses, nil
+}
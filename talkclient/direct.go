@@ -0,0 +1,88 @@
+package talkclient
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// ErrNotConnected is returned by SendTo and RequestTo when the receiver is not connected to the server
+var ErrNotConnected = errors.New("Receiver is not connected")
+
+// ErrClientIDInUse is the reason the connection is lost when the server closed it because another connected client uses Options.ClientID
+var ErrClientIDInUse = errors.New("Client ID is already connected")
+
+// closeReason returns ErrClientIDInUse if the server closed the connection because the client ID is in use, otherwise err
+func closeReason(err error) error {
+	closeErr, ok := err.(*websocket.CloseError)
+	if ok && closeErr.Code == websocket.ClosePolicyViolation {
+		return ErrClientIDInUse
+	}
+	return err
+}
+
+// SendTo sends something to one client, clientID is the ID of that client (Client.ID)
+// The receiver handles the message with its subscriptions to title, other clients don't receive it
+// If the receiver is not connected to the server ErrNotConnected is returned
+func (c *Client) SendTo(clientID string, title string, data interface{}) error {
+	return c.SendToCtx(context.Background(), clientID, title, data)
+}
+
+// SendToCtx is the same as SendTo but stops when ctx ends
+func (c *Client) SendToCtx(ctx context.Context, clientID string, title string, data interface{}) error {
+	return send(ctx, sendOptions{
+		C:     c,
+		Title: title,
+		To:    clientID,
+		Data:  data,
+	})
+}
+
+// RequestTo sends something to one client and waits for its response
+// If the receiver is not connected to the server ErrNotConnected is returned
+// If there is no response within 30 seconds context.DeadlineExceeded is returned
+func (c *Client) RequestTo(clientID string, title string, data interface{}, res interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return c.RequestToCtx(ctx, clientID, title, data, res)
+}
+
+// RequestToCtx is the same as RequestTo but waits until ctx ends instead of 30 seconds
+func (c *Client) RequestToCtx(ctx context.Context, clientID string, title string, data interface{}, res interface{}) error {
+	return send(ctx, sendOptions{
+		C:             c,
+		Title:         title,
+		To:            clientID,
+		ExpectsAnswer: true,
+		Data:          data,
+		Res:           &res,
+	})
+}
+
+// deliveryKey is the key of the pending request that waits for the delivery status of direct message id
+func deliveryKey(id string) string {
+	return src.Hash(src.DeliveredTitle + id)
+}
+
+// handleDeliveryStatus handles the message the server sends back after a direct message
+// Returns false if message isn't a delivery status
+func (c *Client) handleDeliveryStatus(data src.SendMeta) bool {
+	if data.Title != src.DeliveredTitle && data.Title != src.NotConnectedTitle {
+		return false
+	}
+
+	request, ok := c.pending.get(deliveryKey(data.ID))
+	if !ok {
+		return true
+	}
+
+	var err error
+	if data.Title == src.NotConnectedTitle {
+		err = ErrNotConnected
+	}
+	request.resolve(endT{Err: err})
+	return true
+}
@@ -0,0 +1,68 @@
+package talkclient
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// ErrDecryptionFailed is the error a message gets if it can't be decrypted
+// This usually means the sender uses a different Options.EncryptionKey or no encryption at all
+var ErrDecryptionFailed = errors.New("Unable to decrypt message, the sender probably uses a different encryption key")
+
+// newAEAD creates the AES-GCM cipher for a encryption key
+// The key is hashed with sha3-256 so it can have any length
+func newAEAD(key string) (cipher.AEAD, error) {
+	hashedKey := sha3.Sum256([]byte(key))
+	block, err := aes.NewCipher(hashedKey[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds an encrypted payload to the message it's send with
+// so the server can't send it again with another title, ID or as reply to another message
+func additionalData(wireTitle string, id string) []byte {
+	return []byte(wireTitle + id)
+}
+
+// encrypt encrypts a payload before it's send to the server
+// wireTitle and id are the title and ID of the message the payload is send with, see additionalData
+// If no encryption key is set the payload is returned as is
+func (c *Client) encrypt(payload []byte, wireTitle string, id string) ([]byte, error) {
+	if c.aead == nil {
+		return payload, nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, payload, additionalData(wireTitle, id)), nil
+}
+
+// decrypt decrypts a payload received from the server
+// wireTitle and id are the title and ID of the message the payload came with
+// If no encryption key is set the payload is returned as is
+func (c *Client) decrypt(payload []byte, wireTitle string, id string) ([]byte, error) {
+	if c.aead == nil {
+		return payload, nil
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(payload) < nonceSize {
+		return nil, ErrDecryptionFailed
+	}
+
+	out, err := c.aead.Open(nil, payload[:nonceSize], payload[nonceSize:], additionalData(wireTitle, id))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return out, nil
+}
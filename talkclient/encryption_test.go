@@ -0,0 +1,62 @@
+package talkclient
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	c, err := NewClient(Options{EncryptionKey: "group key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewClient(Options{EncryptionKey: "other key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := NewClient(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(`{"order":1}`)
+	encrypted, err := c.encrypt(payload, "title", "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, payload) {
+		t.Fatal("expected the payload to be encrypted")
+	}
+
+	tests := []struct {
+		name   string
+		client *Client
+		title  string
+		id     string
+		ok     bool
+	}{
+		{"same message", c, "title", "id", true},
+		{"other title", c, "other title", "id", false},
+		{"other ID", c, "title", "other id", false},
+		{"other key", other, "title", "id", false},
+	}
+
+	for _, test := range tests {
+		got, err := test.client.decrypt(encrypted, test.title, test.id)
+		if test.ok && (err != nil || !bytes.Equal(got, payload)) {
+			t.Errorf("%s: expected the payload, got %q %v", test.name, got, err)
+		}
+		if !test.ok && err != ErrDecryptionFailed {
+			t.Errorf("%s: expected ErrDecryptionFailed, got %v", test.name, err)
+		}
+	}
+
+	if _, err := c.decrypt([]byte("short"), "title", "id"); err != ErrDecryptionFailed {
+		t.Errorf("expected a too short payload to fail, got %v", err)
+	}
+
+	out, err := plain.encrypt(payload, "title", "id")
+	if err != nil || !bytes.Equal(out, payload) {
+		t.Errorf("expected a client without key to keep the payload, got %q %v", out, err)
+	}
+}
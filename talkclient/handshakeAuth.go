@@ -0,0 +1,54 @@
+package talkclient
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// TokenWithKey returns a handeler for Options.Token that creates tokens signed with key
+// Use this together with talkserver.VerifyToken on the server
+// If key is empty this function will panic
+func TokenWithKey(key string) func() (string, error) {
+	if key == "" {
+		panic("TokenWithKey key is empty")
+	}
+
+	byteKey := []byte(key)
+	return func() (string, error) {
+		return src.NewToken("", byteKey, time.Now()), nil
+	}
+}
+
+// TokenAsIdentity returns a handeler for Options.Token that creates tokens for an identity signed with its key
+// Use this together with talkserver.Registry.VerifyToken on the server
+// If identity or key is empty this function will panic
+func TokenAsIdentity(identity string, key string) func() (string, error) {
+	if identity == "" {
+		panic("TokenAsIdentity identity is empty")
+	}
+	if key == "" {
+		panic("TokenAsIdentity key is empty")
+	}
+
+	byteKey := []byte(key)
+	return func() (string, error) {
+		return src.NewToken(identity, byteKey, time.Now()), nil
+	}
+}
+
+// authHeader returns the headers that authenticate a request to the server
+func (c *Client) authHeader() (http.Header, error) {
+	if c.options.Token == nil {
+		return nil, nil
+	}
+
+	token, err := c.options.Token()
+	if err != nil {
+		return nil, err
+	}
+	return http.Header{
+		"Authorization": []string{"Bearer " + token},
+	}, nil
+}
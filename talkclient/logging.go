@@ -0,0 +1,80 @@
+package talkclient
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mjarkk/socket-talk/talklog"
+)
+
+func toTimePart(in int) string {
+	toReturn := strconv.Itoa(in)
+	if len(toReturn) == 1 {
+		toReturn = "0" + toReturn
+	}
+	return toReturn
+}
+
+// legacyLogger writes the send and received messages to stdout when Client.Logging is true
+// This is the logger used when Options.Logger is not set
+type legacyLogger struct {
+	c *Client
+}
+
+func (l legacyLogger) Log(level talklog.Level, msg string, fields ...talklog.Field) {
+	if !l.c.Logging {
+		return
+	}
+
+	what := msg
+	direction := ""
+	id := ""
+	errMsg := ""
+	for _, field := range fields {
+		switch field.Key {
+		case talklog.KeyTitle:
+			what = fmt.Sprint(field.Value)
+		case talklog.KeyMessageID:
+			id = fmt.Sprint(field.Value)
+		case talklog.KeyDirection:
+			direction = "←"
+			if field.Value == talklog.DirectionSend {
+				direction = "→"
+			}
+		case talklog.KeyError:
+			if err, ok := field.Value.(error); ok && err != nil {
+				errMsg = " " + err.Error()
+			}
+		}
+	}
+	if direction == "" {
+		// Only messages are logged in this format
+		return
+	}
+	if id != "" {
+		what += " id=" + id
+	}
+
+	t := time.Now()
+	seconds := toTimePart(t.Second())
+	minutes := toTimePart(t.Minute())
+	hour := toTimePart(t.Hour())
+	day := toTimePart(t.Day())
+	month := toTimePart(int(t.Month()))
+
+	fmt.Printf(
+		"[SOCK-TALK] %v/%v/%v - %v:%v:%v (%v) %v\n",
+
+		t.Year(),
+		month,
+		day,
+
+		hour,
+		minutes,
+		seconds,
+
+		direction,
+		what+errMsg,
+	)
+}
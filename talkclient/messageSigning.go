@@ -0,0 +1,68 @@
+package talkclient
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// SignWithKey returns a handeler for Options.Auth that signs every message with key
+// Use this together with talkserver.VerifyWithKey on the server
+// If key is empty this function will panic
+func SignWithKey(key string) func([]byte) []byte {
+	if key == "" {
+		panic("SignWithKey key is empty")
+	}
+
+	return signWith("", key)
+}
+
+// SignAsIdentity returns a handeler for Options.Auth that signs every message with the key of an identity
+// Use this when the server has a talkserver.Registry, the identity decides what titles this client can use
+// If identity or key is empty this function will panic
+func SignAsIdentity(identity string, key string) func([]byte) []byte {
+	if identity == "" {
+		panic("SignAsIdentity identity is empty")
+	}
+	if key == "" {
+		panic("SignAsIdentity key is empty")
+	}
+
+	return signWith(identity, key)
+}
+
+// signWith signs every message with key, if identity is set it's added to the message before signing
+func signWith(identity string, key string) func([]byte) []byte {
+	byteKey := []byte(key)
+
+	return func(in []byte) []byte {
+		var meta src.SendMeta
+		err := json.Unmarshal(in, &meta)
+		if err != nil {
+			return in
+		}
+
+		nonce := make([]byte, 16)
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return in
+		}
+
+		meta.Identity = identity
+		meta.Timestamp = time.Now().UnixNano()
+		meta.Nonce = hex.EncodeToString(nonce)
+		meta.Signature, err = src.Sign(byteKey, meta)
+		if err != nil {
+			return in
+		}
+
+		out, err := json.Marshal(meta)
+		if err != nil {
+			return in
+		}
+		return out
+	}
+}
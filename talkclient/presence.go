@@ -0,0 +1,136 @@
+package talkclient
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Peer describes a client connected to the server
+type Peer = src.Peer
+
+// hello tells the server who this client is
+func (c *Client) hello() error {
+	return c.writeMeta(context.Background(), src.SendMeta{
+		Title: src.HelloTitle,
+		Peer: &src.Peer{
+			ID:     c.ID,
+			Name:   c.options.Name,
+			Labels: c.options.Labels,
+		},
+	})
+}
+
+// Peers returns the clients that are connected to the server, this includes this client
+// The clients of the other nodes of the cluster of the server are included, the clients of middlewares that extend it are not
+func (c *Client) Peers() ([]Peer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return c.PeersCtx(ctx)
+}
+
+// PeersCtx is the same as Peers but stops waiting for the server when ctx ends
+func (c *Client) PeersCtx(ctx context.Context) ([]Peer, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	answerTitle := src.Hash(src.PeersTitle + id.String())
+	request := c.pending.add(answerTitle, "SOCKET_TALK_PEERS", 1)
+	defer c.pending.remove(answerTitle)
+
+	err = c.writeMeta(ctx, src.SendMeta{
+		Title: src.PeersTitle,
+		ID:    id.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case answer := <-request.answer:
+		if answer.Err != nil {
+			return nil, answer.Err
+		}
+		peers := []Peer{}
+		err = json.Unmarshal(answer.Bytes, &peers)
+		return peers, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// OnPeerJoined calls handeler every time a client connects to the server
+// The returned subscription can be used to stop receiving these events
+func (c *Client) OnPeerJoined(handeler func(peer Peer)) *Subscription {
+	return c.onPresence(src.PeerJoinedTitle, "SOCKET_TALK_PEER_JOINED", handeler)
+}
+
+// OnPeerLeft calls handeler every time a client disconnects from the server
+// Use this to react when a service you depend on goes away
+// The returned subscription can be used to stop receiving these events
+func (c *Client) OnPeerLeft(handeler func(peer Peer)) *Subscription {
+	return c.onPresence(src.PeerLeftTitle, "SOCKET_TALK_PEER_LEFT", handeler)
+}
+
+func (c *Client) onPresence(wireTitle string, title string, handeler func(peer Peer)) *Subscription {
+	sub := &Subscription{
+		Handeler: func(msg *WSMessage) {
+			var peer Peer
+			if msg.BindJSON(&peer) == nil {
+				handeler(peer)
+			}
+		},
+		Title:     title,
+		wireTitle: wireTitle,
+		client:    c,
+	}
+
+	if c.subscriptions.add(sub) && c.IsConnected() {
+		c.updateSubscriptions(src.SubscribeTitle, "", sub.wireTitle)
+	}
+
+	return sub
+}
+
+// handlePresence handles the messages about peers the server sends
+// Returns false if message isn't a presence message
+func (c *Client) handlePresence(data src.SendMeta) bool {
+	switch data.Title {
+	case src.PeersTitle:
+		request, ok := c.pending.get(src.Hash(src.PeersTitle + data.ID))
+		if !ok {
+			return true
+		}
+		peers, err := json.Marshal(data.Peers)
+		request.resolve(endT{
+			Bytes: peers,
+			Err:   err,
+		})
+		return true
+	case src.PeerJoinedTitle, src.PeerLeftTitle:
+		if data.Peer == nil {
+			return true
+		}
+		peer, err := json.Marshal(data.Peer)
+		if err != nil {
+			return true
+		}
+		for _, sub := range c.subscriptions.get(data.Title, data.Group) {
+			sub.Handeler(&WSMessage{
+				Title: sub.Title,
+				Bytes: peer,
+				BindJSON: func(v interface{}) error {
+					return json.Unmarshal(peer, v)
+				},
+			})
+		}
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,165 @@
+package talkclient
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/mjarkk/socket-talk/talklog"
+)
+
+// State is the connection state of a client started with Start
+type State int
+
+const (
+	// StateDisconnected means the connection is lost, Start will reconnect after a delay
+	StateDisconnected State = iota
+	// StateConnecting means Start is trying to connect to the server
+	StateConnecting
+	// StateConnected means the client is connected and the subscriptions are restored on the server
+	StateConnected
+	// StateGaveUp means Start reached Options.MaxReconnectAttempts and stopped reconnecting
+	StateGaveUp
+	// StateStopped means Stop was called
+	StateStopped
+)
+
+func (s State) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateGaveUp:
+		return "gave up"
+	case StateStopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Start connects to the server in the background and reconnects when the connection is lost
+// The delay between attempts grows exponentially, see the Reconnect fields of Options
+// After every reconnect the subscriptions are restored on the server
+// Use Options.OnStateChange to get notified about the connection state
+// or wait on ConnectChan for the first connection
+func (c *Client) Start() error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.started {
+		return errors.New("Already started")
+	}
+	c.started = true
+	c.stop = make(chan struct{})
+
+	go c.reconnectLoop(c.stop)
+	return nil
+}
+
+// Stop stops the reconnect loop of Start and closes the connection
+func (c *Client) Stop() {
+	c.stateLock.Lock()
+	if !c.started {
+		c.stateLock.Unlock()
+		return
+	}
+	c.started = false
+	close(c.stop)
+	c.stateLock.Unlock()
+}
+
+// State returns the current connection state
+func (c *Client) State() State {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.state
+}
+
+func (c *Client) setState(state State, err error) {
+	c.stateLock.Lock()
+	c.state = state
+	c.stateLock.Unlock()
+
+	level := talklog.LevelInfo
+	if err != nil {
+		level = talklog.LevelWarn
+	}
+	c.logger.Log(level, "Connection "+state.String(),
+		talklog.F(talklog.KeyURL, c.ServerURL),
+		talklog.F(talklog.KeyError, err),
+	)
+
+	if c.options.OnStateChange != nil {
+		c.options.OnStateChange(state, err)
+	}
+}
+
+func (c *Client) reconnectLoop(stop chan struct{}) {
+	attempt := 0
+	for {
+		c.setState(StateConnecting, nil)
+		err := c.dial()
+		if err == nil {
+			c.setState(StateConnected, nil)
+			select {
+			case err = <-c.DisconnectChan:
+			case <-stop:
+				c.Disconnect(nil)
+			}
+			if err != ErrClientIDInUse {
+				// The server accepted the hello, the next connection lost starts counting again
+				attempt = 0
+			}
+		}
+
+		select {
+		case <-stop:
+			c.setState(StateStopped, nil)
+			return
+		default:
+		}
+
+		attempt++
+		if c.options.MaxReconnectAttempts > 0 && attempt >= c.options.MaxReconnectAttempts {
+			c.setState(StateGaveUp, err)
+			c.stateLock.Lock()
+			c.started = false
+			c.stateLock.Unlock()
+			return
+		}
+		c.setState(StateDisconnected, err)
+
+		select {
+		case <-stop:
+			c.setState(StateStopped, nil)
+			return
+		case <-time.After(backoff(attempt, c.options.ReconnectMinDelay, c.options.ReconnectMaxDelay, c.options.ReconnectJitter)):
+		}
+	}
+}
+
+// backoff returns how long to wait before attempt (starting at 1)
+// The delay starts at min and doubles every attempt until it reaches max
+// jitter is the part of the delay that is random
+func backoff(attempt int, min, max time.Duration, jitter float64) time.Duration {
+	delay := min
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	if jitter > 0 {
+		if jitter > 1 {
+			jitter = 1
+		}
+		random := time.Duration(float64(delay) * jitter * rand.Float64())
+		delay = delay - time.Duration(float64(delay)*jitter) + random
+	}
+	return delay
+}
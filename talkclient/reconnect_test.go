@@ -0,0 +1,39 @@
+package talkclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	min := time.Millisecond * 100
+	max := time.Second
+
+	tests := []struct {
+		name    string
+		attempt int
+		jitter  float64
+		least   time.Duration
+		most    time.Duration
+	}{
+		{"first attempt", 1, 0, min, min},
+		{"doubles", 2, 0, min * 2, min * 2},
+		{"doubles every attempt", 4, 0, min * 8, min * 8},
+		{"capped at max", 5, 0, max, max},
+		{"capped after many attempts", 100, 0, max, max},
+		{"negative jitter is no jitter", 2, -1, min * 2, min * 2},
+		{"jitter", 2, 0.5, min, min * 2},
+		{"jitter above 1", 2, 3, 0, min * 2},
+		{"jitter capped at max", 100, 0.5, max / 2, max},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 20; i++ {
+			got := backoff(test.attempt, min, max, test.jitter)
+			if got < test.least || got > test.most {
+				t.Errorf("%s: expected a delay between %s and %s, got %s", test.name, test.least, test.most, got)
+				break
+			}
+		}
+	}
+}
@@ -2,9 +2,10 @@ package talkclient
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -15,6 +16,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/mjarkk/socket-talk/src"
+	"github.com/mjarkk/socket-talk/talklog"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -23,28 +25,47 @@ type CB struct {
 	Res interface{} // The response data,
 }
 
-// SubscribeT is the global type for all subscriptions
-type SubscribeT struct {
-	Handeler     func(msg *WSMessage)
-	Subscription string // The non-hased subscription
-}
+// ErrAuthFailed is returned when the server rejected a message because the authentication failed
+var ErrAuthFailed = errors.New("Authentication failed")
+
+// MaxInlineThreshold is the max value of Options.InlineThreshold
+// An inline payload is base64 encoded in the websocket message, at this size the message stays below the default talkserver.Options.MaxMessageSize
+// The server closes the connection of a client that sends a larger message
+const MaxInlineThreshold = 32768
+
+// errClosed is returned when something is send while the client is not connected
+var errClosed = errors.New("Can't send to a closed connection")
 
 var sockLock sync.Mutex
 
 // Client is the main type from where it's possible to make request
 type Client struct {
+	ID               string // The ID of this client, other clients see this as the sender of messages and use it to send direct messages
 	ServerURL        string
 	ServerWsURL      string
-	Connected        bool
-	Conn             *websocket.Conn
+	Connected        bool            // Changed by the connect and reconnect goroutines while locked, read it with IsConnected
+	Conn             *websocket.Conn // The current connection, see Connected
+	connLock         sync.RWMutex
+	ready            bool // True once the hello is send on the current connection, messages are only published when ready
 	DisconnectChan   chan error
 	ConnectChan      chan struct{}
 	innerConnectChan chan struct{}
-	Subscriptions    map[string]SubscribeT
 	Auth             func([]byte) []byte
 	NoProxy          bool
 	Logging          bool
 	SendedToChan     bool
+	InlineThreshold  int
+	aead             cipher.AEAD
+	options          Options
+	subscriptions    *subscriptions
+	pending          *pendingRequests
+	recent           *recentIDs
+	logger           talklog.Logger
+
+	stateLock sync.Mutex
+	state     State
+	started   bool
+	stop      chan struct{}
 }
 
 // Options are options that can be used in the NewClient function
@@ -52,7 +73,76 @@ type Options struct {
 	Auth      func([]byte) []byte // A function to authenticate the message if not spesified this will be ignored
 	ServerURL string              // server url, default: http://localhost:8080/
 	NoProxy   bool                // Turn off proxy settings
-	Logging   bool                // If this is true the request will be logged
+	Logging   bool                // If this is true the request will be logged, this is ignored when Logger is set
+
+	// Logger receives structured log entries about messages and the connection
+	// Use talklog.NewStdLogger or talklog.NewJSONLogger or implement talklog.Logger
+	// default: the send and received messages are written to stdout if Logging is true
+	Logger talklog.Logger
+
+	// EncryptionKey is a key shared by a group of clients, if set all payloads are encrypted with it
+	// The middleware will only see the encrypted payloads
+	// Clients with a different key (or no key) can't read the messages of this client
+	EncryptionKey string
+
+	// Token creates the token that authenticates the connection, it's called for every connection and cache request
+	// Use this together with talkserver.Options.HandshakeAuth
+	// Use TokenWithKey or TokenAsIdentity, if not spesified no token is send
+	Token func() (string, error)
+
+	// Payloads smaller than InlineThreshold bytes are send inside the websocket message
+	// instead of being stored in the middleware cache, this saves 2 http requests per message
+	// default: 1024, set to -1 to always use the middleware cache
+	// The max is MaxInlineThreshold, a server with a lower talkserver.Options.MaxMessageSize needs a lower value
+	InlineThreshold int
+
+	// ReconnectMinDelay is the delay before the first reconnect attempt of Start, default: 500ms
+	// Every next attempt the delay is doubled until it reaches ReconnectMaxDelay
+	ReconnectMinDelay time.Duration
+	// ReconnectMaxDelay is the max delay between reconnect attempts of Start, default: 30 seconds
+	ReconnectMaxDelay time.Duration
+	// ReconnectJitter is the part of the reconnect delay that is random (0 to 1) so not all clients reconnect at the same time
+	// default: 0.5, set to a negative number to disable the jitter
+	ReconnectJitter float64
+	// MaxReconnectAttempts is the amount of failed connection attempts in a row after which Start gives up
+	// default: 0, never give up
+	MaxReconnectAttempts int
+	// OnStateChange is called by Start every time the connection state changes
+	// err is set when the state changed because of an error
+	OnStateChange func(state State, err error)
+
+	// SureSendAttempts is the max amount of times SureSend sends a message before it gives up, default: 5
+	SureSendAttempts int
+	// SureSendAckTimeout is how long SureSend waits for an acknowledgement before it sends the message again, default: 5 seconds
+	SureSendAckTimeout time.Duration
+	// DedupWindow is how long the IDs of received SureSend messages are remembered
+	// A re-send of a message within this window is acknowledged again but not handed to the subscriptions
+	// default: 2 minutes
+	DedupWindow time.Duration
+
+	// ClientID is the ID of this client, default: a random ID
+	// Set this to a stable ID so other clients can keep sending direct messages to this client after a restart
+	// The server closes the connection with ErrClientIDInUse if another connected client uses the same ID,
+	// Start keeps retrying until the ID is free, these attempts count towards MaxReconnectAttempts
+	// With a talkserver.Registry a client of the same identity takes the ID over, for when the server didn't notice the old connection is gone
+	ClientID string
+
+	// Name is the name of the service this client belongs to, other clients see it in Client.Peers and the peer events
+	Name string
+	// Labels is extra information about this client like a version or region, other clients see it together with Name
+	Labels map[string]string
+
+	// TitleHints adds the plain title to every message that is send, this is meant for debugging
+	// Receivers without a subscription to the title show the hint in their logs instead of "foreign topic"
+	// and the middleware shows it instead of the hashed title
+	// Don't enable this if the titles should stay hidden for the middleware
+	TitleHints bool
+
+	// PlainTitles sends the titles as plain text instead of hashing every level
+	// Use this when subscriptions with wildcards need to know the full title of a message (WSMessage.Title),
+	// with hashed titles the levels matched by a wildcard can only be shown as hash
+	// All clients that talk to each other need to use the same setting
+	PlainTitles bool
 }
 
 // NewClient creates a new client object
@@ -63,6 +153,47 @@ func NewClient(options Options) (*Client, error) {
 		Auth:        options.Auth,
 		NoProxy:     options.NoProxy,
 		Logging:     options.Logging,
+
+		InlineThreshold: 1024,
+	}
+
+	if options.InlineThreshold > MaxInlineThreshold {
+		return nil, errors.New("InlineThreshold can't be larger than " + strconv.Itoa(MaxInlineThreshold))
+	}
+	if options.InlineThreshold != 0 {
+		client.InlineThreshold = options.InlineThreshold
+	}
+	if options.ReconnectMinDelay == 0 {
+		options.ReconnectMinDelay = time.Millisecond * 500
+	}
+	if options.ReconnectMaxDelay == 0 {
+		options.ReconnectMaxDelay = time.Second * 30
+	}
+	if options.ReconnectJitter == 0 {
+		options.ReconnectJitter = 0.5
+	}
+	if options.SureSendAttempts == 0 {
+		options.SureSendAttempts = 5
+	}
+	if options.SureSendAckTimeout == 0 {
+		options.SureSendAckTimeout = time.Second * 5
+	}
+	if options.DedupWindow == 0 {
+		options.DedupWindow = time.Minute * 2
+	}
+	client.options = options
+
+	client.logger = options.Logger
+	if client.logger == nil {
+		client.logger = legacyLogger{client}
+	}
+
+	if options.EncryptionKey != "" {
+		aead, err := newAEAD(options.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		client.aead = aead
 	}
 
 	if options.ServerURL != "" {
@@ -80,10 +211,20 @@ func NewClient(options Options) (*Client, error) {
 		client.ServerWsURL = strings.Replace(client.ServerWsURL, "http://", "ws://", 1)
 	}
 
-	client.DisconnectChan = make(chan error)
+	client.DisconnectChan = make(chan error, 1)
 	client.ConnectChan = make(chan struct{})
-	client.innerConnectChan = make(chan struct{})
-	client.Subscriptions = map[string]SubscribeT{}
+	client.innerConnectChan = make(chan struct{}, 1)
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	client.ID = id.String()
+	if options.ClientID != "" {
+		client.ID = options.ClientID
+	}
+	client.subscriptions = newSubscriptions()
+	client.pending = newPendingRequests()
+	client.recent = newRecentIDs(options.DedupWindow)
 
 	go messageHandeler(client)
 
@@ -91,9 +232,20 @@ func NewClient(options Options) (*Client, error) {
 }
 
 // Connect connects the client to a websocket
-// If the client is already connected it will return nil
+// This blocks until the connection is lost and returns the reason
+// Most of the time you want to use Start instead as that also reconnects when the connection is lost
 func (c *Client) Connect() error {
-	if c.Connected {
+	err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	return <-c.DisconnectChan
+}
+
+// dial creates the websocket connection and restores the subscriptions on the server
+func (c *Client) dial() error {
+	if c.IsConnected() {
 		return errors.New("Already connected")
 	}
 
@@ -106,174 +258,394 @@ func (c *Client) Connect() error {
 		dailer.Proxy = http.ProxyFromEnvironment
 	}
 
-	conn, _, err := dailer.Dial(c.ServerWsURL+"socketTalk/ws", nil)
+	header, err := c.authHeader()
+	if err != nil {
+		return err
+	}
+
+	conn, res, err := dailer.Dial(c.ServerWsURL+"socketTalk/ws", header)
 	if err != nil {
+		if res != nil && res.StatusCode == http.StatusUnauthorized {
+			return ErrAuthFailed
+		}
 		return err
 	}
+
+	// Remove a disconnect error of a previous connection that nobody has read
+	select {
+	case <-c.DisconnectChan:
+	default:
+	}
+
+	c.connLock.Lock()
 	c.Connected = true
 	c.Conn = conn
+	c.connLock.Unlock()
+
+	for group, titles := range c.subscriptions.titles() {
+		err = c.updateSubscriptions(src.SubscribeTitle, group, titles...)
+		if err != nil {
+			c.closeConn()
+			return err
+		}
+	}
+	for _, request := range c.pending.answerRequests() {
+		err = c.updateAnswerSubscription(src.SubscribeTitle, request.replyTo, request.id)
+		if err != nil {
+			c.closeConn()
+			return err
+		}
+	}
+
+	err = c.hello()
+	if err != nil {
+		c.closeConn()
+		return err
+	}
+
+	// Messages can only be published after the hello,
+	// otherwise the server doesn't know the client ID yet and sends them without a sender
+	c.connLock.Lock()
+	c.ready = c.Connected && c.Conn == conn
+	c.connLock.Unlock()
+
 	if !c.SendedToChan {
-		c.ConnectChan <- struct{}{}
+		close(c.ConnectChan)
 	}
 	c.SendedToChan = true
 	c.innerConnectChan <- struct{}{}
 
-	return <-c.DisconnectChan
+	return nil
 }
 
 // WSMessage is a websocket message
 type WSMessage struct {
+	Title         string                    // The title of the message, if the subscription has wildcards see Options.PlainTitles
 	Bytes         []byte                    // The actual message
+	Err           error                     // Err is set when the message couldn't be read, for example ErrDecryptionFailed
 	ExpectsAnswer bool                      // ExectsAnswer is true when the sender expects an answer back
 	Aswer         func(data interface{})    // Aswer sends a message back to the sender
 	BindJSON      func(v interface{}) error // Bind the json data to something, this is the same as json.Unmarshal
 }
 
-func toTimePart(in int) string {
-	toReturn := strconv.Itoa(in)
-	if len(toReturn) == 1 {
-		toReturn = "0" + toReturn
+// messageHandeler handles all incomming message
+func messageHandeler(c *Client) {
+	for {
+		<-c.innerConnectChan
+		conn := c.currentConn()
+		if conn == nil {
+			// Disconnected before this goroutine got to the connection
+			continue
+		}
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				c.Disconnect(closeReason(err))
+				break
+			}
+			go c.handleMessage(message)
+		}
 	}
-	return toReturn
 }
 
-func (c *Client) log(sendOrRec bool, what string) {
-	if c.Logging {
-		direction := "←"
-		if sendOrRec {
-			direction = "→"
-		}
-
-		t := time.Now()
-		seconds := toTimePart(t.Second())
-		minutes := toTimePart(t.Minute())
-		hour := toTimePart(t.Hour())
-		day := toTimePart(t.Day())
-		month := toTimePart(int(t.Month()))
-
-		fmt.Printf(
-			"[SOCK-TALK] %v/%v/%v - %v:%v:%v (%v) %v\n",
+// handleMessage handles one incomming message
+func (c *Client) handleMessage(message []byte) {
+	var data src.SendMeta
+	err := json.Unmarshal(message, &data)
+	if err != nil {
+		return
+	}
 
-			t.Year(),
-			month,
-			day,
+	if data.Title == src.AuthFailedTitle {
+		c.logger.Log(talklog.LevelError, "Server rejected a message, authentication failed",
+			talklog.F(talklog.KeyTitle, "SOCKET_TALK_AUTH_FAILED"),
+			talklog.F(talklog.KeyDirection, talklog.DirectionReceive),
+		)
+		c.pending.failAll(ErrAuthFailed)
+		return
+	}
 
-			hour,
-			minutes,
-			seconds,
+	if c.handlePresence(data) || c.handleDeliveryStatus(data) {
+		return
+	}
 
-			direction,
-			what,
+	request, isAnswer := c.pending.get(data.Title)
+	subs := c.subscriptions.get(data.Title, data.Group)
+	if !isAnswer && len(subs) == 0 {
+		c.logger.Log(talklog.LevelDebug, "Received message without subscription",
+			talklog.F(talklog.KeyTitle, foreignTitle(data)),
+			talklog.F(talklog.KeyMessageID, data.ID),
+			talklog.F(talklog.KeyDirection, talklog.DirectionReceive),
 		)
+		return
 	}
-}
 
-// messageHandeler handles all incomming message
-func messageHandeler(c *Client) {
-	for {
-		if !c.Connected {
-			<-c.innerConnectChan
-		}
-		_, message, err := c.Conn.ReadMessage()
+	var title string
+	if isAnswer {
+		title = request.title + replyLabel
+	} else {
+		title = c.resolveTitle(subs[0], data.Title)
+	}
+
+	start := time.Now()
+	postBytes := data.Payload
+	if postBytes == nil && data.MessageID != "" {
+		postBytes, err = c.post(context.Background(), c.ServerURL+"socketTalk/get", struct {
+			ID string `json:"ID"`
+		}{
+			ID: data.MessageID,
+		})
 		if err != nil {
-			c.Disconnect(err)
-			continue
+			c.logger.Log(talklog.LevelError, "Can't fetch the payload of a message",
+				talklog.F(talklog.KeyTitle, title),
+				talklog.F(talklog.KeyMessageID, data.ID),
+				talklog.F(talklog.KeyDirection, talklog.DirectionReceive),
+				talklog.F(talklog.KeyError, err),
+			)
+			return
 		}
-		go func(message []byte) {
-			var data src.SendMeta
-			err := json.Unmarshal(message, &data)
-			if err != nil {
-				return
-			}
+	}
 
-			sub, ok := c.Subscriptions[data.Title]
-			if !ok {
-				c.log(false, data.Title)
-				return
-			}
+	postBytes, decryptErr := c.decrypt(postBytes, data.Title, data.ID)
+	level := talklog.LevelDebug
+	if decryptErr != nil {
+		level = talklog.LevelWarn
+	}
+	c.logger.Log(level, "Received message",
+		talklog.F(talklog.KeyTitle, title),
+		talklog.F(talklog.KeyMessageID, data.ID),
+		talklog.F(talklog.KeyDirection, talklog.DirectionReceive),
+		talklog.F(talklog.KeySize, len(postBytes)),
+		talklog.F(talklog.KeyDuration, time.Since(start)),
+		talklog.F(talklog.KeyError, decryptErr),
+	)
+
+	if isAnswer {
+		request.resolve(endT{
+			From:  data.From,
+			Bytes: postBytes,
+			Err:   decryptErr,
+		})
+	}
 
-			c.log(false, sub.Subscription)
-
-			postBytes := []byte{}
-			if data.MessageID != "" {
-				postBytes, err = post(c.ServerURL+"socketTalk/get", struct {
-					ID string `json:"ID"`
-				}{
-					ID: data.MessageID,
-				}, c.NoProxy)
-				if err != nil {
-					return
-				}
-			}
+	if data.NeedsAck {
+		defer c.ack(data, title)
+		if !c.recent.add(data.Title + data.Group + data.ID) {
+			// This is a re-send of a message we already handled, the sender probably didn't receive our ack
+			return
+		}
+	}
 
-			sub.Handeler(&WSMessage{
-				Bytes:         postBytes,
-				ExpectsAnswer: data.ExpectsAnswer,
-				Aswer: func(content interface{}) {
-					send(sendOptions{
-						C:             c,
-						Title:         data.Title + data.ID,
-						ExpectsAnswer: false,
-						Data:          content,
-					}, sendOverwrites{
-						ID: data.ID,
-					})
-				},
-				BindJSON: func(v interface{}) error {
-					return json.Unmarshal(postBytes, &v)
-				},
-			})
-		}(message)
+	for _, sub := range subs {
+		subTitle := c.resolveTitle(sub, data.Title)
+		sub.Handeler(&WSMessage{
+			Title:         subTitle,
+			Bytes:         postBytes,
+			Err:           decryptErr,
+			ExpectsAnswer: data.ExpectsAnswer,
+			Aswer: func(content interface{}) {
+				send(context.Background(), sendOptions{
+					C:             c,
+					Title:         subTitle + replyLabel,
+					HashedTitle:   src.Hash(data.Title + data.ID),
+					ReplyTo:       data.Title,
+					ExpectsAnswer: false,
+					Data:          content,
+				}, sendOverwrites{
+					ID: data.ID,
+				})
+			},
+			BindJSON: func(v interface{}) error {
+				if decryptErr != nil {
+					return decryptErr
+				}
+				return json.Unmarshal(postBytes, &v)
+			},
+		})
 	}
 }
 
 // Subscribe can subscibe to a spesific title
+// A title can have multiple levels separated by dots like "orders.created",
+// to match multiple titles use "*" for exactly one level ("orders.*") or ">" for one or more levels at the end ("orders.>")
+// Multiple handelers can subscribe to the same title
+// The returned subscription can be used to unsubscribe
 // Example handeler:
 //
 // func(msg *talkclient.WSMessage)  {
 //   fmt.Println(string(msg.Bytes))
 //   return nil
 // }
-func (c *Client) Subscribe(title string, handeler func(msg *WSMessage)) {
-	c.Subscriptions[src.Hash(title)] = SubscribeT{
-		handeler,
-		title,
+func (c *Client) Subscribe(title string, handeler func(msg *WSMessage)) *Subscription {
+	return c.SubscribeQueue(title, "", handeler)
+}
+
+// SubscribeQueue subscribes to a title as member of a queue group
+// Of all clients that subscribed with the same group only one receives a message,
+// the server picks them round robin so the messages are spread over the group members
+// Clients that subscribed with Subscribe still receive every message
+// An empty group is the same as Subscribe
+func (c *Client) SubscribeQueue(title string, group string, handeler func(msg *WSMessage)) *Subscription {
+	sub := &Subscription{
+		Handeler:  handeler,
+		Title:     title,
+		Group:     group,
+		wireTitle: c.wireTitle(title),
+		client:    c,
+	}
+
+	if c.subscriptions.add(sub) && c.IsConnected() {
+		c.updateSubscriptions(src.SubscribeTitle, group, sub.wireTitle)
 	}
+
+	return sub
 }
 
-// Disconnect disconnects the currnet connection
-func (c *Client) Disconnect(err error) {
+// updateSubscriptions tells the server to start or stop sending messages with the hashed titles to this client
+// kind must be src.SubscribeTitle or src.UnsubscribeTitle
+// group is the queue group of the subscriptions, empty for normal subscriptions
+func (c *Client) updateSubscriptions(kind string, group string, hashedTitles ...string) error {
+	if len(hashedTitles) == 0 {
+		return nil
+	}
+
+	return c.writeMeta(context.Background(), src.SendMeta{
+		Title:  kind,
+		Topics: hashedTitles,
+		Group:  group,
+	})
+}
+
+// updateAnswerSubscription tells the server to start or stop sending the answers to the message with hashed title replyTo and ID id to this client
+// kind must be src.SubscribeTitle or src.UnsubscribeTitle
+func (c *Client) updateAnswerSubscription(kind string, replyTo string, id string) error {
+	return c.writeMeta(context.Background(), src.SendMeta{
+		Title:   kind,
+		ID:      id,
+		Topics:  []string{src.Hash(replyTo + id)},
+		ReplyTo: replyTo,
+	})
+}
+
+// writeMeta writes meta to the websocket
+// The deadline of ctx is used as write deadline
+func (c *Client) writeMeta(ctx context.Context, meta src.SendMeta) error {
+	jsonData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if c.Auth != nil {
+		jsonData = c.Auth(jsonData)
+	}
+
+	conn := c.currentConn()
+	if conn == nil {
+		return errClosed
+	}
+
+	sockLock.Lock()
+	defer sockLock.Unlock()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	deadline, _ := ctx.Deadline()
+	conn.SetWriteDeadline(deadline)
+	err = conn.WriteMessage(1, jsonData)
+	conn.SetWriteDeadline(time.Time{})
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// IsConnected returns true if the client is connected to the server
+// It's safe to use while the client reconnects, unlike reading Connected directly
+func (c *Client) IsConnected() bool {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.Connected
+}
+
+// isReady returns true if the client is connected and has send its hello, see Client.ready
+func (c *Client) isReady() bool {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.ready
+}
+
+// currentConn returns the connection if the client is connected, otherwise nil
+func (c *Client) currentConn() *websocket.Conn {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+
 	if !c.Connected {
-		return
+		return nil
+	}
+	return c.Conn
+}
+
+// closeConn marks the client as disconnected and closes the connection
+// Returns false if the client was not connected
+func (c *Client) closeConn() bool {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	if !c.Connected {
+		return false
 	}
 	c.Connected = false
+	c.ready = false
 	c.Conn.Close()
-	c.DisconnectChan <- err
+	return true
+}
+
+// Disconnect disconnects the currnet connection
+func (c *Client) Disconnect(err error) {
+	if !c.closeConn() {
+		return
+	}
+	select {
+	case c.DisconnectChan <- err:
+	default:
+	}
 }
 
 // post makes a post request
-func post(url string, msg interface{}, noProxy bool) ([]byte, error) {
-	buf := new(bytes.Buffer)
+func (c *Client) post(ctx context.Context, url string, msg interface{}) ([]byte, error) {
+	body := []byte{}
 
 	if msg != nil {
 		jsonData, err := json.Marshal(msg)
 		if err != nil {
 			return nil, err
 		}
+		body = jsonData
+	}
 
-		_, err = buf.WriteString(string(jsonData))
-		if err != nil {
-			return nil, err
-		}
+	return c.postBytes(ctx, url, body)
+}
+
+// postBytes makes a post request with body as request body
+func (c *Client) postBytes(ctx context.Context, url string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
 	}
+	req = req.WithContext(ctx)
 
-	req, err := http.NewRequest("POST", url, buf)
+	header, err := c.authHeader()
 	if err != nil {
 		return nil, err
 	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
 
 	client := &http.Client{}
-	if noProxy {
+	if c.NoProxy {
 		var transport http.RoundTripper = &http.Transport{
 			Proxy: nil,
 		}
@@ -281,20 +653,36 @@ func post(url string, msg interface{}, noProxy bool) ([]byte, error) {
 	}
 	res, err := client.Do(req)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
+	defer res.Body.Close()
 
 	rawOut, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, ErrAuthFailed
+	}
+	if res.StatusCode != 200 {
+		return nil, errors.New("Server responded with status " + strconv.Itoa(res.StatusCode) + ": " + string(rawOut))
+	}
+
 	return rawOut, nil
 }
 
 type sendOptions struct {
 	C             *Client
 	Title         string
+	HashedTitle   string // The title used on the wire, default: the hash of Title
+	ReplyTo       string // The hashed title of the message this message answers
+	To            string // The ID of the client that should receive the message, empty for a broadcast
+	MaxAnswers    int    // The amount of answers that can be buffered when ExpectsAnswer is true, default: 1
+	NeedsAck      bool   // The receivers should acknowledge the message, the ack is received like an answer
 	ExpectsAnswer bool
 	Data          interface{}
 	Res           interface{}
@@ -305,111 +693,179 @@ type sendOverwrites struct {
 }
 
 type endT struct {
+	From  string
 	Bytes []byte
 	Err   error
 }
 
 // send is the underlaying function that sends something into the network
-func send(options sendOptions, overwrites ...sendOverwrites) error {
-	if !options.C.Connected {
-		return errors.New("Can't send to a closed connection")
+// If the context ends before the message is send or the answer is received ctx.Err() is returned
+func send(ctx context.Context, options sendOptions, overwrites ...sendOverwrites) error {
+	request, done, err := publish(ctx, options, overwrites...)
+	if err != nil || request == nil {
+		return err
+	}
+	defer done()
+
+	var returnData endT
+	select {
+	case returnData = <-request.answer:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if returnData.Err != nil {
+		return returnData.Err
 	}
 
-	messageID, err := post(options.C.ServerURL+"socketTalk/set", options.Data, options.C.NoProxy)
+	err = json.Unmarshal(returnData.Bytes, &options.Res)
 	if err != nil {
 		return err
 	}
 
+	return nil
+}
+
+// publish writes a message to the network
+// If the message expects an answer the returned request receives the answers,
+// done must be called when no more answers are needed
+func publish(ctx context.Context, options sendOptions, overwrites ...sendOverwrites) (request *pendingRequest, done func(), err error) {
+	if !options.C.isReady() {
+		return nil, nil, errClosed
+	}
+	start := time.Now()
+
 	id := ""
 	if len(overwrites) > 0 {
 		id = overwrites[0].ID
 	} else {
 		uuid, err := uuid.NewV4()
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		id = uuid.String()
 	}
 
-	hashedTitle := src.Hash(options.Title)
-	sendToWS := src.SendMeta{
-		ID:            id,
-		MessageID:     string(messageID),
-		ExpectsAnswer: options.ExpectsAnswer,
-		Title:         hashedTitle,
+	hashedTitle := options.HashedTitle
+	if hashedTitle == "" {
+		if src.HasWildcard(options.Title) {
+			return nil, nil, ErrWildcardTitle
+		}
+		hashedTitle = options.C.wireTitle(options.Title)
 	}
 
-	jsonData, err := json.Marshal(sendToWS)
-	if err != nil {
-		return err
+	payload := []byte{}
+	if options.Data != nil {
+		jsonData, err := json.Marshal(options.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+		payload = jsonData
 	}
 
-	options.C.log(true, options.Title)
-
-	if options.C.Auth == nil {
-		sockLock.Lock()
-		err = options.C.Conn.WriteMessage(1, jsonData)
-		sockLock.Unlock()
-	} else {
-		sockLock.Lock()
-		err = options.C.Conn.WriteMessage(1, options.C.Auth(jsonData))
-		sockLock.Unlock()
-	}
+	payload, err = options.C.encrypt(payload, hashedTitle, id)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if !options.ExpectsAnswer {
-		return nil
+	var inlinePayload []byte
+	messageID := []byte{}
+	if len(payload) < options.C.InlineThreshold {
+		inlinePayload = payload
+	} else {
+		messageID, err = options.C.postBytes(ctx, options.C.ServerURL+"socketTalk/set", payload)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	end := make(chan endT)
-	go func() {
-		time.Sleep(time.Second * 30)
-		close(end)
-	}()
-
 	subID := src.Hash(hashedTitle + id)
+	if options.ExpectsAnswer || options.NeedsAck {
+		maxAnswers := options.MaxAnswers
+		if maxAnswers == 0 {
+			maxAnswers = 1
+		}
+		request = options.C.pending.addAnswer(subID, options.Title, maxAnswers, hashedTitle, id)
+		done = func() {
+			options.C.pending.remove(subID)
+			options.C.updateAnswerSubscription(src.UnsubscribeTitle, hashedTitle, id)
+		}
 
-	options.C.Subscriptions[subID] = SubscribeT{
-		Handeler: func(msg *WSMessage) {
-			end <- endT{
-				Bytes: msg.Bytes,
-			}
-		},
-		Subscription: options.Title,
+		// The server needs to know about the answer title before the message is send
+		// otherwise a fast answer might not be routed to this client
+		err = options.C.updateAnswerSubscription(src.SubscribeTitle, hashedTitle, id)
+		if err != nil {
+			done()
+			return nil, nil, err
+		}
 	}
 
-	options.C.Subscriptions[src.Hash("SOCKET_TALK_AUTH_FAILED")] = SubscribeT{
-		Handeler: func(msg *WSMessage) {
-			end <- endT{
-				Err: errors.New("Authentication failed"),
-			}
-		},
-		Subscription: "SOCKET_TALK_AUTH_FAILED",
+	var delivery *pendingRequest
+	if len(options.To) > 0 {
+		// The server tells right away if the receiver is connected
+		delivery = options.C.pending.add(deliveryKey(id), options.Title, 1)
+		defer options.C.pending.remove(deliveryKey(id))
 	}
 
-	returnData, ok := <-end
-	delete(options.C.Subscriptions, subID)
-	if !ok {
-		return errors.New("Request timed out")
+	titleHint := ""
+	if options.C.options.TitleHints {
+		titleHint = options.Title
 	}
 
-	if returnData.Err != nil {
-		return returnData.Err
+	err = options.C.writeMeta(ctx, src.SendMeta{
+		ID:            id,
+		From:          options.C.ID,
+		To:            options.To,
+		MessageID:     string(messageID),
+		Payload:       inlinePayload,
+		ExpectsAnswer: options.ExpectsAnswer,
+		NeedsAck:      options.NeedsAck,
+		Title:         hashedTitle,
+		TitleHint:     titleHint,
+		ReplyTo:       options.ReplyTo,
+	})
+	if err != nil {
+		if done != nil {
+			done()
+		}
+		return nil, nil, err
 	}
 
-	err = json.Unmarshal(returnData.Bytes, &options.Res)
-	if err != nil {
-		return err
+	options.C.logger.Log(talklog.LevelDebug, "Send message",
+		talklog.F(talklog.KeyTitle, options.Title),
+		talklog.F(talklog.KeyMessageID, id),
+		talklog.F(talklog.KeyDirection, talklog.DirectionSend),
+		talklog.F(talklog.KeySize, len(payload)),
+		talklog.F(talklog.KeyDuration, time.Since(start)),
+	)
+
+	if delivery != nil {
+		select {
+		case status := <-delivery.answer:
+			err = status.Err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			if done != nil {
+				done()
+			}
+			return nil, nil, err
+		}
 	}
 
-	return nil
+	return request, done, nil
 }
 
 // Send just sends something into the network
 func (c *Client) Send(title string, data interface{}) error {
-	return send(sendOptions{
+	return c.SendCtx(context.Background(), title, data)
+}
+
+// SendCtx is the same as Send but stops when ctx ends
+// The returned error is ctx.Err() if the context ended before the message was send
+func (c *Client) SendCtx(ctx context.Context, title string, data interface{}) error {
+	return send(ctx, sendOptions{
 		C:     c,
 		Title: title,
 		Data:  data,
@@ -417,17 +873,19 @@ func (c *Client) Send(title string, data interface{}) error {
 	})
 }
 
-// SureSend sends something into the network and wait for some respone on this message
-// If there is no res, it will re-send it
-// Use this when you need to be sure the message will actualy be delivered
-func (c *Client) SureSend(title string, data interface{}) error {
-	var res interface{}
-	return c.SendAndReceive(title, data, &res)
-}
-
 // SendAndReceive sends something into the network and waits for a response from someone
+// If there is no response within 30 seconds context.DeadlineExceeded is returned
 func (c *Client) SendAndReceive(title string, data interface{}, res interface{}) error {
-	return send(sendOptions{
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	return c.SendAndReceiveCtx(ctx, title, data, res)
+}
+
+// SendAndReceiveCtx is the same as SendAndReceive but waits until ctx ends instead of 30 seconds
+// The returned error is ctx.Err() if the context ended before a response was received,
+// so use errors.Is(err, context.DeadlineExceeded) or errors.Is(err, context.Canceled) to check why
+func (c *Client) SendAndReceiveCtx(ctx context.Context, title string, data interface{}, res interface{}) error {
+	return send(ctx, sendOptions{
 		C:             c,
 		Title:         title,
 		ExpectsAnswer: true,
@@ -0,0 +1,206 @@
+package talkclient
+
+import (
+	"sync"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// Subscription is a handle to a subscription created with Client.Subscribe or Client.SubscribeQueue
+type Subscription struct {
+	Handeler  func(msg *WSMessage)
+	Title     string // The non-hased title, this can contain wildcards
+	Group     string // The queue group, empty for subscriptions created with Subscribe
+	wireTitle string
+	client    *Client
+}
+
+// Unsubscribe removes the subscription
+// If this was the last subscription to the title the server will stop sending messages with this title to the client
+func (s *Subscription) Unsubscribe() {
+	if s.client.subscriptions.remove(s) && s.client.IsConnected() {
+		s.client.updateSubscriptions(src.UnsubscribeTitle, s.Group, s.wireTitle)
+	}
+}
+
+// subscriptionKey is what the server knows a subscription by
+type subscriptionKey struct {
+	wireTitle string
+	group     string
+}
+
+// subscriptions keeps track of all subscriptions of a client
+// it's safe to use from multiple goroutines
+type subscriptions struct {
+	lock      sync.RWMutex
+	byKey     map[subscriptionKey][]*Subscription
+	wildcards map[subscriptionKey]struct{} // All keys in byKey that have a title with a wildcard
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		byKey:     map[subscriptionKey][]*Subscription{},
+		wildcards: map[subscriptionKey]struct{}{},
+	}
+}
+
+// add adds a subscription
+// Returns true if this is the first subscription to its title and group
+func (s *subscriptions) add(sub *Subscription) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := subscriptionKey{sub.wireTitle, sub.Group}
+	s.byKey[key] = append(s.byKey[key], sub)
+	if src.HasWildcard(sub.wireTitle) {
+		s.wildcards[key] = struct{}{}
+	}
+	return len(s.byKey[key]) == 1
+}
+
+// remove removes a subscription
+// Returns true if this was the last subscription to its title and group
+func (s *subscriptions) remove(sub *Subscription) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := subscriptionKey{sub.wireTitle, sub.Group}
+	list := s.byKey[key]
+	for i, item := range list {
+		if item != sub {
+			continue
+		}
+
+		list = append(list[:i:i], list[i+1:]...)
+		if len(list) == 0 {
+			delete(s.byKey, key)
+			delete(s.wildcards, key)
+			return true
+		}
+		s.byKey[key] = list
+		return false
+	}
+	return false
+}
+
+// get returns all subscriptions of group to a title including the wildcard subscriptions that match the title
+// Use an empty group to get the subscriptions created with Subscribe
+func (s *subscriptions) get(wireTitle string, group string) []*Subscription {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	toReturn := s.byKey[subscriptionKey{wireTitle, group}]
+	for key := range s.wildcards {
+		if key.group == group && key.wireTitle != wireTitle && src.MatchTitle(key.wireTitle, wireTitle) {
+			// Limit the capacity so append never writes into the slice stored in byKey
+			toReturn = append(toReturn[:len(toReturn):len(toReturn)], s.byKey[key]...)
+		}
+	}
+	return toReturn
+}
+
+// titles returns all wire titles that have at least one subscription grouped by queue group
+func (s *subscriptions) titles() map[string][]string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	toReturn := map[string][]string{}
+	for key := range s.byKey {
+		toReturn[key.group] = append(toReturn[key.group], key.wireTitle)
+	}
+	return toReturn
+}
+
+// pendingRequest is a request that is waiting for an answer
+type pendingRequest struct {
+	title  string // The non-hashed title of the request
+	answer chan endT
+
+	// These fields are only set when the answers are routed by the server to this client
+	replyTo string // The hashed title of the request
+	id      string // The ID of the request
+}
+
+// resolve hands an answer to the request
+// If the request can't buffer more answers the answer is dropped
+func (r *pendingRequest) resolve(answer endT) {
+	select {
+	case r.answer <- answer:
+	default:
+	}
+}
+
+// pendingRequests keeps track of all requests waiting for an answer
+// the requests are stored by the hashed title the answer will be send to
+type pendingRequests struct {
+	lock     sync.Mutex
+	requests map[string]*pendingRequest
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		requests: map[string]*pendingRequest{},
+	}
+}
+
+// add adds a new pending request that can buffer maxAnswers answers
+// Use this for requests the server answers directly, use addAnswer for answers of other clients
+func (p *pendingRequests) add(answerTitle string, title string, maxAnswers int) *pendingRequest {
+	return p.addAnswer(answerTitle, title, maxAnswers, "", "")
+}
+
+// addAnswer adds a new pending request for the answers to the message with hashed title replyTo and ID id
+func (p *pendingRequests) addAnswer(answerTitle string, title string, maxAnswers int, replyTo string, id string) *pendingRequest {
+	request := &pendingRequest{
+		title:   title,
+		answer:  make(chan endT, maxAnswers),
+		replyTo: replyTo,
+		id:      id,
+	}
+
+	p.lock.Lock()
+	p.requests[answerTitle] = request
+	p.lock.Unlock()
+
+	return request
+}
+
+// remove removes a pending request
+func (p *pendingRequests) remove(answerTitle string) {
+	p.lock.Lock()
+	delete(p.requests, answerTitle)
+	p.lock.Unlock()
+}
+
+// get returns the request waiting for an answer on answerTitle
+func (p *pendingRequests) get(answerTitle string) (*pendingRequest, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	request, ok := p.requests[answerTitle]
+	return request, ok
+}
+
+// failAll resolves all pending requests with err
+func (p *pendingRequests) failAll(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, request := range p.requests {
+		request.resolve(endT{Err: err})
+	}
+}
+
+// answerRequests returns the pending requests that wait for answers of other clients
+func (p *pendingRequests) answerRequests() []*pendingRequest {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	toReturn := []*pendingRequest{}
+	for _, request := range p.requests {
+		if len(request.replyTo) > 0 {
+			toReturn = append(toReturn, request)
+		}
+	}
+	return toReturn
+}
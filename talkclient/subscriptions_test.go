@@ -0,0 +1,62 @@
+package talkclient
+
+import (
+	"testing"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+func TestSubscriptionsGet(t *testing.T) {
+	subs := newSubscriptions()
+	subscribe := func(title string, group string) *Subscription {
+		sub := &Subscription{Title: title, Group: group, wireTitle: src.HashTitle(title)}
+		subs.add(sub)
+		return sub
+	}
+
+	// 3 subscriptions so the slice in byKey has room for more
+	exact := []*Subscription{
+		subscribe("orders.created", ""),
+		subscribe("orders.created", ""),
+		subscribe("orders.created", ""),
+	}
+	single := subscribe("orders.*", "")
+	multi := subscribe(">", "")
+	subscribe("invoices.*", "")
+	worker := subscribe("orders.*", "workers")
+
+	tests := []struct {
+		name  string
+		title string
+		group string
+		want  []*Subscription
+	}{
+		{"exact and wildcards", "orders.created", "", append(append([]*Subscription{}, exact...), single, multi)},
+		{"only wildcards", "orders.deleted", "", []*Subscription{single, multi}},
+		{"multi level wildcard", "orders.created.eu", "", []*Subscription{multi}},
+		{"group", "orders.created", "workers", []*Subscription{worker}},
+		{"unknown group", "orders.created", "other", nil},
+	}
+
+	for _, test := range tests {
+		got := subs.get(src.HashTitle(test.title), test.group)
+		if len(got) != len(test.want) {
+			t.Errorf("%s: expected %d subscriptions, got %d", test.name, len(test.want), len(got))
+			continue
+		}
+		for _, want := range test.want {
+			found := false
+			for _, sub := range got {
+				found = found || sub == want
+			}
+			if !found {
+				t.Errorf("%s: expected subscription to %s", test.name, want.Title)
+			}
+		}
+	}
+
+	stored := subs.byKey[subscriptionKey{src.HashTitle("orders.created"), ""}]
+	if cap(stored) > len(stored) && stored[:cap(stored)][len(stored)] != nil {
+		t.Error("expected get to not write the wildcard subscriptions into the stored slice")
+	}
+}
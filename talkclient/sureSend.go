@@ -0,0 +1,158 @@
+package talkclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mjarkk/socket-talk/src"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ErrNotDelivered is returned by SureSend when none of the attempts got acknowledged
+// The returned error wraps the error of the last attempt, use errors.Is(err, ErrNotDelivered) to check for it
+var ErrNotDelivered = errors.New("Message was not acknowledged by any receiver")
+
+// notDeliveredError is ErrNotDelivered together with the error of the last attempt
+type notDeliveredError struct {
+	err error
+}
+
+func (e *notDeliveredError) Error() string {
+	return ErrNotDelivered.Error() + ": " + e.err.Error()
+}
+
+func (e *notDeliveredError) Is(target error) bool {
+	return target == ErrNotDelivered
+}
+
+func (e *notDeliveredError) Unwrap() error {
+	return e.err
+}
+
+// SureSend sends something into the network and waits until a receiver acknowledges it
+// If there is no acknowledgement within Options.SureSendAckTimeout it will re-send it,
+// between the attempts it waits the same way as Start does between reconnects
+// A re-send uses the same message ID so receivers will only hand it once to their subscriptions
+// Only a missing acknowledgement or a closed connection is retried, other errors are returned right away
+// Use this when you need to be sure the message will actualy be delivered
+func (c *Client) SureSend(title string, data interface{}) error {
+	return c.SureSendCtx(context.Background(), title, data)
+}
+
+// SureSendCtx is the same as SureSend but stops when ctx ends
+func (c *Client) SureSendCtx(ctx context.Context, title string, data interface{}) error {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = c.sureSendAttempt(ctx, title, data, id.String())
+		if err == nil || !retry || ctx.Err() != nil {
+			return err
+		}
+
+		if attempt >= c.options.SureSendAttempts {
+			return &notDeliveredError{err}
+		}
+
+		select {
+		case <-time.After(backoff(attempt, c.options.ReconnectMinDelay, c.options.ReconnectMaxDelay, c.options.ReconnectJitter)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// sureSendAttempt sends a message one time and waits for the acknowledgement
+// Returns true if the attempt can be retried, that is when there was no acknowledgement or the connection was closed
+func (c *Client) sureSendAttempt(ctx context.Context, title string, data interface{}, id string) (retry bool, err error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, c.options.SureSendAckTimeout)
+	defer cancel()
+
+	request, done, err := publish(attemptCtx, sendOptions{
+		C:        c,
+		Title:    title,
+		NeedsAck: true,
+		Data:     data,
+	}, sendOverwrites{
+		ID: id,
+	})
+	if err != nil {
+		return isConnectionError(err) || (attemptCtx.Err() != nil && ctx.Err() == nil), err
+	}
+	defer done()
+
+	select {
+	case answer := <-request.answer:
+		return false, answer.Err
+	case <-attemptCtx.Done():
+		return ctx.Err() == nil, attemptCtx.Err()
+	}
+}
+
+// isConnectionError returns true if err is caused by a connection that is closed or broke
+func isConnectionError(err error) bool {
+	if err == errClosed || err == websocket.ErrCloseSent {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// ack acknowledges a message that was send with SureSend
+// title is the plain title of the message, it's only used for logging
+func (c *Client) ack(data src.SendMeta, title string) {
+	publish(context.Background(), sendOptions{
+		C:           c,
+		Title:       title + ackLabel,
+		HashedTitle: src.Hash(data.Title + data.ID),
+		ReplyTo:     data.Title,
+	}, sendOverwrites{
+		ID: data.ID,
+	})
+}
+
+// recentIDs remembers the messages received within a time window
+type recentIDs struct {
+	lock      sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time
+	lastClean time.Time
+}
+
+func newRecentIDs(window time.Duration) *recentIDs {
+	return &recentIDs{
+		window:    window,
+		seen:      map[string]time.Time{},
+		lastClean: time.Now(),
+	}
+}
+
+// add remembers id
+// Returns false if id was already seen within the window
+func (r *recentIDs) add(id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastClean) > r.window {
+		for key, seenAt := range r.seen {
+			if now.Sub(seenAt) > r.window {
+				delete(r.seen, key)
+			}
+		}
+		r.lastClean = now
+	}
+
+	if seenAt, ok := r.seen[id]; ok && now.Sub(seenAt) <= r.window {
+		return false
+	}
+	r.seen[id] = now
+	return true
+}
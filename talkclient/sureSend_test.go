@@ -0,0 +1,82 @@
+package talkclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRecentIDs(t *testing.T) {
+	recent := newRecentIDs(time.Millisecond * 20)
+
+	if !recent.add("a") {
+		t.Error("expected a new ID to be added")
+	}
+	if recent.add("a") {
+		t.Error("expected a re-send within the window to be seen")
+	}
+	if !recent.add("b") {
+		t.Error("expected another ID to be added")
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	if !recent.add("a") {
+		t.Error("expected an ID to be forgotten after the window")
+	}
+	if _, ok := recent.seen["b"]; ok {
+		t.Error("expected the IDs outside the window to be cleaned up")
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		retry bool
+	}{
+		{"closed", errClosed, true},
+		{"close send", websocket.ErrCloseSent, true},
+		{"network", &net.OpError{Op: "write", Err: io.ErrClosedPipe}, true},
+		{"wildcard title", ErrWildcardTitle, false},
+		{"auth failed", ErrAuthFailed, false},
+		{"server status", errors.New("Server responded with status 507: Cache is full"), false},
+		{"canceled", context.Canceled, false},
+	}
+
+	for _, test := range tests {
+		if got := isConnectionError(test.err); got != test.retry {
+			t.Errorf("%s: expected %v, got %v", test.name, test.retry, got)
+		}
+	}
+}
+
+func TestSureSendNotConnected(t *testing.T) {
+	c, err := NewClient(Options{
+		SureSendAttempts:  3,
+		ReconnectMinDelay: time.Millisecond,
+		ReconnectMaxDelay: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.SureSend("orders.created", nil)
+	if !errors.Is(err, ErrNotDelivered) {
+		t.Errorf("expected ErrNotDelivered, got %v", err)
+	}
+	if !errors.Is(err, errClosed) {
+		t.Errorf("expected the error of the last attempt to be wrapped, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = c.SureSendCtx(ctx, "orders.created", nil)
+	if errors.Is(err, ErrNotDelivered) {
+		t.Errorf("expected a canceled context to stop the retries right away, got %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package talkclient
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// ErrWildcardTitle is returned when sending a message to a title with wildcards
+var ErrWildcardTitle = errors.New("Can't send a message to a title with wildcards")
+
+// wireTitle returns the title as it's send over the network
+func (c *Client) wireTitle(title string) string {
+	if c.options.PlainTitles {
+		return title
+	}
+	return src.HashTitle(title)
+}
+
+// Labels added to titles in the logs
+const (
+	replyLabel        = " (reply)"
+	ackLabel          = " (ack)"
+	foreignTopicLabel = "foreign topic"
+)
+
+// foreignTitle returns the title to show in the logs for a message this client has no subscription or request for
+// The hashed title can't be reversed so unless the sender added a title hint the title is unknown
+func foreignTitle(data src.SendMeta) string {
+	if data.TitleHint != "" {
+		return data.TitleHint + " (" + foreignTopicLabel + ")"
+	}
+	return foreignTopicLabel
+}
+
+// resolveTitle returns the title of a message received by sub
+// With hashed titles the levels matched by a wildcard are unknown so they stay hashed
+func (c *Client) resolveTitle(sub *Subscription, wireTitle string) string {
+	if c.options.PlainTitles {
+		return wireTitle
+	}
+	if !src.HasWildcard(sub.Title) {
+		return sub.Title
+	}
+
+	patternLevels := strings.Split(sub.Title, src.TitleSeparator)
+	levels := strings.Split(wireTitle, src.TitleSeparator)
+	for i, level := range patternLevels {
+		if i >= len(levels) || level == src.MultiWildcard {
+			break
+		}
+		if level != src.SingleWildcard {
+			levels[i] = level
+		}
+	}
+	return strings.Join(levels, src.TitleSeparator)
+}
@@ -0,0 +1,189 @@
+// Package talklog contains the logger interface used by talkclient and talkserver
+// Implement Logger to send the logs of socket talk to your own log pipeline
+// or use one of the adapters NewStdLogger and NewJSONLogger
+package talklog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the importance of a log entry
+type Level int
+
+const (
+	// LevelDebug is used for every message that is send or received
+	LevelDebug Level = iota
+	// LevelInfo is used for connection changes
+	LevelInfo
+	// LevelWarn is used for problems socket talk can recover from, like a lost connection
+	LevelWarn
+	// LevelError is used for problems that make a message or connection fail
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseLevel returns the level with the name debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %q, use debug, info, warn or error", name)
+}
+
+// The keys of the fields socket talk adds to log entries
+const (
+	KeyTitle     = "title"     // The non-hashed title of a message if known, otherwise the hashed title
+	KeyMessageID = "messageID" // The ID of a message
+	KeyDirection = "direction" // "send" or "receive"
+	KeySize      = "size"      // The size of a payload or frame in bytes
+	KeyDuration  = "duration"  // How long something took, a time.Duration
+	KeyError     = "error"     // An error
+	KeyURL       = "url"       // The url of a server
+)
+
+// Directions used as value of KeyDirection
+const (
+	DirectionSend    = "send"
+	DirectionReceive = "receive"
+)
+
+// Field is a key value pair that adds information to a log entry
+// Fields with a nil value are left out
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Logger receives the log entries of socket talk
+// Log can be called from multiple goroutines at the same time
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// Nop is a logger that drops everything
+var Nop Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(level Level, msg string, fields ...Field) {}
+
+// stdLogger writes to a logger of the log package
+type stdLogger struct {
+	logger   *log.Logger
+	minLevel Level
+}
+
+// NewStdLogger creates a logger that writes the entries to l with key=value fields
+// If l is nil the entries are written to stderr
+// Entries below minLevel are dropped
+func NewStdLogger(l *log.Logger, minLevel Level) Logger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &stdLogger{
+		logger:   l,
+		minLevel: minLevel,
+	}
+}
+
+func (l *stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.minLevel {
+		return
+	}
+
+	line := strings.Builder{}
+	line.WriteString("[" + strings.ToUpper(level.String()) + "] " + msg)
+	for _, field := range fields {
+		if field.Value == nil {
+			continue
+		}
+		value := fmt.Sprint(fieldValue(field.Value))
+		if strings.ContainsAny(value, " \"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		line.WriteString(" " + field.Key + "=" + value)
+	}
+	l.logger.Println(line.String())
+}
+
+// jsonLogger writes every entry as a json object on its own line
+type jsonLogger struct {
+	lock     sync.Mutex
+	out      io.Writer
+	minLevel Level
+}
+
+// NewJSONLogger creates a logger that writes every entry as a json object on its own line to w
+// The object contains the keys time, level and msg together with the fields
+// Entries below minLevel are dropped
+func NewJSONLogger(w io.Writer, minLevel Level) Logger {
+	return &jsonLogger{
+		out:      w,
+		minLevel: minLevel,
+	}
+}
+
+func (l *jsonLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.minLevel {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for _, field := range fields {
+		if field.Value != nil {
+			entry[field.Key] = fieldValue(field.Value)
+		}
+	}
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// fieldValue converts values that don't print or marshal nicely
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	default:
+		return value
+	}
+}
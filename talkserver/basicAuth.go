@@ -6,9 +6,12 @@ import (
 	"github.com/mjarkk/socket-talk/src"
 )
 
-// AuthWithKey is an auth function that
+// AuthWithKey is an auth function that checks if messages start with the hash of key
 // If the key is an empty string it will panic
 // This returns a function that can be used as Options.Auth
+//
+// Deprecated: every message contains the same prefix so a captured message can be replayed,
+// use VerifyWithKey together with talkclient.SignWithKey instead
 func AuthWithKey(key string) func(msg []byte) ([]byte, bool) {
 	if key == "" {
 		panic("AuthWithKey key is empty")
@@ -0,0 +1,307 @@
+package talkserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+	"github.com/mjarkk/socket-talk/talklog"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ExpectedReaders can be used as Options.CacheReads to remove a payload
+// as soon as every session the message was routed to has fetched it
+const ExpectedReaders = -1
+
+var (
+	errEntryTooLarge = errors.New("Payload is too large")
+	errCacheFull     = errors.New("Cache is full")
+)
+
+type getCachePost struct {
+	ID string `json:"ID"`
+}
+
+type cacheEntry struct {
+	id      string
+	expires time.Time
+}
+
+// cache wraps a Store and applies the cache limits set in the Options
+type cache struct {
+	store    Store
+	ttl      time.Duration
+	maxEntry int64
+	maxTotal int64
+	reads    int
+
+	lock      sync.Mutex
+	order     []cacheEntry // All entries ordered from old to new, used to evict the oldest entries
+	readsLeft map[string]int
+	unrouted  map[string]struct{} // The entries no message was routed with yet, only used with ExpectedReaders
+}
+
+func newCache(o *Options) *cache {
+	ttl := o.CacheTTL
+	if ttl == 0 {
+		ttl = time.Second * 20
+	}
+
+	return &cache{
+		store:     o.Store,
+		ttl:       ttl,
+		maxEntry:  o.MaxCacheEntrySize,
+		maxTotal:  o.MaxCacheSize,
+		reads:     o.CacheReads,
+		readsLeft: map[string]int{},
+		unrouted:  map[string]struct{}{},
+	}
+}
+
+// add adds a payload to the cache and returns the ID of the payload
+func (c *cache) add(toAdd []byte) (string, error) {
+	size := int64(len(toAdd))
+	if c.maxEntry > 0 && size > c.maxEntry {
+		return "", errEntryTooLarge
+	}
+
+	uuid, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	id := src.Hash(uuid.String())
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	for len(c.order) > 0 && now.After(c.order[0].expires) {
+		expired := c.order[0]
+		c.order = c.order[1:]
+		delete(c.readsLeft, expired.id)
+		delete(c.unrouted, expired.id)
+		// The store might not have cleaned it up yet, its bytes would otherwise still count towards the max cache size
+		err = c.expire(expired.id)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if c.maxTotal > 0 {
+		if size > c.maxTotal {
+			return "", errCacheFull
+		}
+		for len(c.order) > 0 && c.store.Stats().Bytes+size > c.maxTotal {
+			oldest := c.order[0]
+			c.order = c.order[1:]
+			delete(c.readsLeft, oldest.id)
+			delete(c.unrouted, oldest.id)
+			err = c.store.Delete(oldest.id)
+			if err != nil {
+				return "", err
+			}
+		}
+		if c.store.Stats().Bytes+size > c.maxTotal {
+			return "", errCacheFull
+		}
+	}
+
+	err = c.store.Put(id, toAdd, c.ttl)
+	if err != nil {
+		return "", err
+	}
+
+	c.order = append(c.order, cacheEntry{
+		id:      id,
+		expires: now.Add(c.ttl),
+	})
+	if c.reads > 0 {
+		c.readsLeft[id] = c.reads
+	} else if c.reads == ExpectedReaders {
+		c.unrouted[id] = struct{}{}
+	}
+
+	return id, nil
+}
+
+// expire removes an expired payload from the store
+// The built in stores count it as expired, other stores only get a Delete
+func (c *cache) expire(id string) error {
+	if e, ok := c.store.(expirer); ok {
+		return e.expire(id)
+	}
+	return c.store.Delete(id)
+}
+
+// get returns a payload from the cache
+// If the payload reached its max amount of reads it's removed
+func (c *cache) get(id string) ([]byte, error) {
+	c.lock.Lock()
+	left, limited := c.readsLeft[id]
+	if limited {
+		if left <= 0 {
+			c.lock.Unlock()
+			return nil, ErrNotFound
+		}
+		// Keep the entry at 0 so concurrent reads can't see it as unlimited
+		// it will be cleaned up when the payload expires
+		left--
+		c.readsLeft[id] = left
+	}
+	c.lock.Unlock()
+
+	data, err := c.store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if limited && left == 0 {
+		c.store.Delete(id)
+	}
+	return data, nil
+}
+
+// expectReads sets the amount of reads left for a payload to the amount of sessions a message was routed to
+// This only does something if the cache reads are set to ExpectedReaders
+// Only the first message routed with the payload counts,
+// otherwise a client that received the ID could send it again to a title without subscribers to remove the payload
+func (c *cache) expectReads(id string, readers int) {
+	if c.reads != ExpectedReaders || id == "" {
+		return
+	}
+
+	c.lock.Lock()
+	if _, ok := c.unrouted[id]; !ok {
+		c.lock.Unlock()
+		return
+	}
+	delete(c.unrouted, id)
+	c.readsLeft[id] = readers
+	c.lock.Unlock()
+
+	if readers == 0 {
+		c.store.Delete(id)
+	}
+}
+
+// proxy sends the request to url and responds with its response
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, url string) {
+	proxyErr := func(err error) {
+		s.options.Logger.Log(talklog.LevelError, "Can't proxy cache request",
+			talklog.F(talklog.KeyURL, url),
+			talklog.F(talklog.KeyError, err),
+		)
+		writeString(w, 400, "CACHE SET PROXY ERROR: "+err.Error())
+	}
+
+	req, err := http.NewRequest("POST", url, r.Body)
+	if err != nil {
+		proxyErr(err)
+		return
+	}
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	if s.options.ExtendToken != nil {
+		// The client authenticated with this middleware, this middleware authenticates with the other one
+		token, err := s.options.ExtendToken()
+		if err != nil {
+			proxyErr(err)
+			return
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		proxyErr(err)
+		return
+	}
+	defer res.Body.Close()
+
+	rawOut, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		proxyErr(err)
+		return
+	}
+
+	writeData(w, res.StatusCode, "text/plain", rawOut)
+}
+
+// serveSet adds a payload to the cache and responds with its ID
+func (s *Server) serveSet(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.handshakeAuth(w, r); !ok {
+		return
+	}
+	if len(s.options.ExtendURL) > 0 {
+		s.proxy(w, r, s.options.ExtendURL+"/socketTalk/set")
+		return
+	}
+
+	var body io.Reader = r.Body
+	if s.cache.maxEntry > 0 {
+		// Read 1 byte more than allowed so we can detect a payload that is too large
+		body = io.LimitReader(body, s.cache.maxEntry+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		writeString(w, 400, err.Error())
+		return
+	}
+
+	id, err := s.cache.add(data)
+	switch err {
+	case nil:
+		writeString(w, 200, id)
+	case errEntryTooLarge:
+		writeString(w, http.StatusRequestEntityTooLarge, err.Error())
+	case errCacheFull:
+		writeString(w, http.StatusInsufficientStorage, err.Error())
+	default:
+		writeString(w, 500, err.Error())
+	}
+}
+
+// serveGet responds with a payload of the cache
+func (s *Server) serveGet(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.handshakeAuth(w, r); !ok {
+		return
+	}
+	if len(s.options.ExtendURL) > 0 {
+		s.proxy(w, r, s.options.ExtendURL+"/socketTalk/get")
+		return
+	}
+
+	var data getCachePost
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		writeString(w, 400, err.Error())
+		return
+	}
+
+	cacheItem, err := s.cache.get(data.ID)
+	if err == ErrNotFound && len(s.nodes) > 0 && s.requestNode(r) == "" {
+		// The payload might be stored by another node of the cluster
+		var ok bool
+		cacheItem, ok = s.fetchFromNodes(data.ID)
+		if ok {
+			err = nil
+		}
+	}
+	if err == ErrNotFound {
+		atomic.AddUint64(&s.metrics.cacheMisses, 1)
+		writeString(w, 404, err.Error())
+		return
+	} else if err != nil {
+		writeString(w, 500, err.Error())
+		return
+	}
+
+	atomic.AddUint64(&s.metrics.cacheHits, 1)
+	writeData(w, 200, "text/plain", cacheItem)
+}
@@ -0,0 +1,71 @@
+package talkserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheExpectReadsOnlyFirstRoute(t *testing.T) {
+	c := newCache(&Options{
+		Store:      NewMemoryStore(),
+		CacheReads: ExpectedReaders,
+	})
+
+	id, err := c.add([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.expectReads(id, 2)
+	// A message send again with the same payload ID to a title without subscribers
+	c.expectReads(id, 0)
+
+	for i := 0; i < 2; i++ {
+		data, err := c.get(id)
+		if err != nil {
+			t.Fatalf("read %d: %v", i+1, err)
+		}
+		if string(data) != "payload" {
+			t.Fatalf("read %d: expected payload, got %q", i+1, data)
+		}
+	}
+	if _, err := c.get(id); err != ErrNotFound {
+		t.Errorf("expected the payload to be removed after the expected reads, got %v", err)
+	}
+
+	c.expectReads("unknown", 1)
+	if _, ok := c.readsLeft["unknown"]; ok {
+		t.Error("expected an unknown payload ID to be ignored")
+	}
+}
+
+func TestCacheAddRemovesExpiredEntries(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+	c := newCache(&Options{
+		Store:        store,
+		CacheTTL:     time.Millisecond * 10,
+		MaxCacheSize: 10,
+	})
+
+	_, err := c.add([]byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	id, err := c.add([]byte("01234"))
+	if err != nil {
+		t.Fatalf("expected the expired payload to make room, got %v", err)
+	}
+	stats := store.Stats()
+	if stats.Bytes != 5 {
+		t.Errorf("expected the store to contain 5 bytes, got %d", stats.Bytes)
+	}
+	if stats.Expired != 1 {
+		t.Errorf("expected the removed payload to count as expired, got %d", stats.Expired)
+	}
+	if _, err := c.get(id); err != nil {
+		t.Errorf("expected the new payload to be readable, got %v", err)
+	}
+}
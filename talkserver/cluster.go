@@ -0,0 +1,127 @@
+package talkserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+	"github.com/mjarkk/socket-talk/talklog"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// nodeHeader is the header a node of the cluster sends its node token in when it connects to another node, see nodeToken
+const nodeHeader = "X-Socket-Talk-Node"
+
+// nodeTokenMaxAge is how old a node token can be
+const nodeTokenMaxAge = time.Second * 30
+
+// nodeKey is the melody session key that contains the ID of the node of the cluster the session belongs to
+const nodeKey = "node"
+
+// dedupeWindow is how long the messages received from other middlewares are remembered to drop duplicates
+const dedupeWindow = time.Minute
+
+// isNode returns true if the session is the connection of another node of the cluster
+// Messages from other middlewares are never routed to these sessions, the nodes receive them over their own links
+// and their subscriptions are not forwarded to other middlewares
+func isNode(sess *melody.Session) bool {
+	if sess == nil {
+		return false
+	}
+	node, ok := sess.Get(nodeKey)
+	return ok && node != nil && node != ""
+}
+
+// nodeToken returns a token that proves this middleware is a node of the cluster
+// It's signed with Options.ClusterKey and contains the ID of this middleware as identity
+func (s *Server) nodeToken() string {
+	return src.NewToken(s.id, []byte(s.options.ClusterKey), time.Now())
+}
+
+// requestNode returns the ID of the node of the cluster that sent the request
+// Returns an empty string if the request has no node token signed with Options.ClusterKey,
+// a client can't pretend to be a node as then it could send messages as any other client
+func (s *Server) requestNode(r *http.Request) string {
+	token := r.Header.Get(nodeHeader)
+	if token == "" || s.options.ClusterKey == "" {
+		return ""
+	}
+
+	key := []byte(s.options.ClusterKey)
+	node, ok := src.VerifyToken(token, func(string) ([]byte, bool) {
+		return key, true
+	}, nodeTokenMaxAge)
+	if !ok {
+		return ""
+	}
+	return node
+}
+
+// dedupeKey identifies a transmission of a message that can come in over multiple links
+// The ID of the message is not used as a client re-sends a message with the same ID (see talkclient.SureSend),
+// the origin gives every frame it receives from its clients a new number
+// Returns false for messages without a frame number, they can't be told apart
+func dedupeKey(meta src.SendMeta) (string, bool) {
+	if meta.Origin == "" || meta.Frame == 0 {
+		return "", false
+	}
+	return meta.Origin + "." + strconv.FormatUint(meta.Frame, 10), true
+}
+
+// stamp marks a message from a session of this middleware as from this middleware with a new frame number
+// so it's recognized if it comes back over another middleware and can be de-duplicated by the other middlewares
+func (s *Server) stamp(meta *src.SendMeta) {
+	meta.Origin = s.id
+	meta.Frame = atomic.AddUint64(&s.frames, 1)
+}
+
+// clustered returns true if this middleware forwards messages to other middlewares
+func (s *Server) clustered() bool {
+	return s.upstream != nil || len(s.nodes) > 0
+}
+
+// fetchFromNodes asks the other nodes of the cluster for a payload this node doesn't have
+// Returns false if none of the nodes has the payload
+func (s *Server) fetchFromNodes(id string) ([]byte, bool) {
+	body, err := json.Marshal(getCachePost{ID: id})
+	if err != nil {
+		return nil, false
+	}
+
+	client := &http.Client{Timeout: time.Second * 10}
+	for _, node := range s.nodes {
+		header, err := node.authHeader()
+		if err != nil {
+			continue
+		}
+
+		req, err := http.NewRequest("POST", node.url+"/socketTalk/get", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header = header
+		req.Header.Set("Content-Type", "application/json")
+		// Tells the node to only look in its own cache
+		req.Header.Set(nodeHeader, s.nodeToken())
+
+		res, err := client.Do(req)
+		if err != nil {
+			s.options.Logger.Log(talklog.LevelWarn, "Can't fetch payload from cluster node",
+				talklog.F(talklog.KeyURL, node.url),
+				talklog.F(talklog.KeyError, err),
+			)
+			continue
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err == nil && res.StatusCode == 200 {
+			return data, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,37 @@
+package talkserver
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRequestNode(t *testing.T) {
+	node := &Server{id: "node-1", options: &Options{ClusterKey: "node key"}}
+	server := &Server{id: "node-2", options: &Options{ClusterKey: "node key"}}
+
+	request := func(token string) *http.Request {
+		r, err := http.NewRequest("GET", "/socketTalk/ws", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			r.Header.Set(nodeHeader, token)
+		}
+		return r
+	}
+
+	if got := server.requestNode(request(node.nodeToken())); got != "node-1" {
+		t.Errorf("expected the request to be from node-1, got %q", got)
+	}
+	if got := server.requestNode(request("")); got != "" {
+		t.Errorf("expected a request without a node token to not be from a node, got %q", got)
+	}
+	if got := server.requestNode(request("node-1")); got != "" {
+		t.Errorf("expected a plain node ID to be ignored, got %q", got)
+	}
+
+	other := &Server{id: "node-3", options: &Options{ClusterKey: "other key"}}
+	if got := server.requestNode(request(other.nodeToken())); got != "" {
+		t.Errorf("expected a node token with another key to be ignored, got %q", got)
+	}
+}
@@ -0,0 +1,70 @@
+package talkserver
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// identityKey is the melody session key that contains the identity the session authenticated as
+const identityKey = "identity"
+
+// VerifyToken is a handshake auth function that checks tokens created by talkclient.TokenWithKey
+// Tokens older than maxAge are rejected, if maxAge is 0 it defaults to 30 seconds
+// If the key is an empty string it will panic
+// This returns a function that can be used as Options.HandshakeAuth
+func VerifyToken(key string, maxAge time.Duration) func(token string) (string, bool) {
+	if key == "" {
+		panic("VerifyToken key is empty")
+	}
+	if maxAge == 0 {
+		maxAge = time.Second * 30
+	}
+
+	byteKey := []byte(key)
+	keyFor := func(identity string) ([]byte, bool) {
+		return byteKey, identity == ""
+	}
+
+	return func(token string) (string, bool) {
+		return src.VerifyToken(token, keyFor, maxAge)
+	}
+}
+
+// VerifyToken checks tokens created by talkclient.TokenAsIdentity with the key of the identity
+// Use it as Options.HandshakeAuth, sessions are then bound to the identity of their token
+func (r *Registry) VerifyToken(token string) (string, bool) {
+	return src.VerifyToken(token, func(name string) ([]byte, bool) {
+		identity, ok := r.Get(name)
+		return []byte(identity.Key), ok
+	}, r.maxAge)
+}
+
+// requestToken returns the token of a request
+// The token is read from the header "Authorization: Bearer <token>" or the query parameter token
+func requestToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// handshakeAuth checks the token of a request and responds with 401 Unauthorized if it's not valid
+// Returns the identity of the token and false if the request was rejected
+func (s *Server) handshakeAuth(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.options.HandshakeAuth == nil {
+		return "", true
+	}
+
+	identity, ok := s.options.HandshakeAuth(requestToken(r))
+	if !ok {
+		atomic.AddUint64(&s.metrics.authFailures, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+		return "", false
+	}
+	return identity, true
+}
@@ -0,0 +1,50 @@
+package talkserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+func TestVerifyToken(t *testing.T) {
+	verify := VerifyToken("handshake key", time.Second*30)
+
+	if _, ok := verify(src.NewToken("", []byte("handshake key"), time.Now())); !ok {
+		t.Error("expected a valid token to be accepted")
+	}
+	if _, ok := verify(src.NewToken("", []byte("handshake key"), time.Now().Add(-time.Minute))); ok {
+		t.Error("expected an expired token to be rejected")
+	}
+	if _, ok := verify(src.NewToken("", []byte("other key"), time.Now())); ok {
+		t.Error("expected a token with the wrong key to be rejected")
+	}
+	if _, ok := verify(src.NewToken("billing", []byte("handshake key"), time.Now())); ok {
+		t.Error("expected a token with an identity to be rejected")
+	}
+	if _, ok := verify("not a token"); ok {
+		t.Error("expected a malformed token to be rejected")
+	}
+}
+
+func TestRegistryVerifyToken(t *testing.T) {
+	registry := NewRegistry(time.Second * 30)
+	err := registry.Set(Identity{Name: "billing", Key: "billing key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, ok := registry.VerifyToken(src.NewToken("billing", []byte("billing key"), time.Now()))
+	if !ok || identity != "billing" {
+		t.Errorf("expected the token to be accepted as billing, got %q %v", identity, ok)
+	}
+	if _, ok := registry.VerifyToken(src.NewToken("billing", []byte("billing key"), time.Now().Add(-time.Minute))); ok {
+		t.Error("expected an expired token to be rejected")
+	}
+	if _, ok := registry.VerifyToken(src.NewToken("billing", []byte("other key"), time.Now())); ok {
+		t.Error("expected a token with the wrong key to be rejected")
+	}
+	if _, ok := registry.VerifyToken(src.NewToken("unknown", []byte("billing key"), time.Now())); ok {
+		t.Error("expected a token of an unknown identity to be rejected")
+	}
+}
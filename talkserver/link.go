@@ -0,0 +1,341 @@
+package talkserver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mjarkk/socket-talk/src"
+	"github.com/mjarkk/socket-talk/talklog"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// The delays between the attempts to connect to another middleware
+const (
+	linkMinDelay = time.Millisecond * 500
+	linkMaxDelay = time.Second * 30
+)
+
+// childHeader is the header a middleware that extends this middleware sends its link token in, see Options.LinkKey
+const childHeader = "X-Socket-Talk-Child"
+
+// childKey is the melody session key that is true for the connection of a middleware that extends this middleware
+const childKey = "child"
+
+// errNotLinked is returned when there is no connection to the other middleware
+var errNotLinked = errors.New("Not connected to middleware")
+
+// link is a connection from this middleware to another middleware
+// The other middleware is the one this middleware extends (Options.ExtendURL) or another node of the cluster (Options.Cluster)
+// Over the link this middleware subscribes to the titles of its sessions and receives the messages for them
+type link struct {
+	url   string
+	wsURL string
+	node  bool
+	token func() (string, error)
+	auth  func(msg []byte) []byte
+
+	lock sync.Mutex
+	conn *websocket.Conn
+}
+
+func newLink(url string, node bool, token func() (string, error), auth func(msg []byte) []byte) *link {
+	url = strings.TrimSuffix(url, "/")
+	return &link{
+		url:   url,
+		wsURL: toWSURL(url),
+		node:  node,
+		token: token,
+		auth:  auth,
+	}
+}
+
+// toWSURL changes the scheme of a http url to the matching websocket scheme
+func toWSURL(url string) string {
+	return strings.Replace(strings.Replace(url, "https:", "wss:", -1), "http:", "ws:", -1)
+}
+
+// connected returns true if the connection to the other middleware is up
+func (l *link) connected() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.conn != nil
+}
+
+// authHeader returns the header to authenticate with the other middleware
+func (l *link) authHeader() (http.Header, error) {
+	header := http.Header{}
+	if l.token != nil {
+		token, err := l.token()
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header, nil
+}
+
+// write writes meta to the other middleware
+// The message is signed with the auth function of the link if set
+func (l *link) write(meta src.SendMeta) error {
+	msg, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if l.auth != nil {
+		msg = l.auth(msg)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.conn == nil {
+		return errNotLinked
+	}
+	return l.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// links returns the connections to all other middlewares
+func (s *Server) links() []*link {
+	if s.upstream == nil {
+		return s.nodes
+	}
+	return append([]*link{s.upstream}, s.nodes...)
+}
+
+// linkLoop keeps the connection of l open
+// The messages the other middleware sends over it are routed to the sessions of this middleware
+func (s *Server) linkLoop(l *link) {
+	delay := linkMinDelay
+	for !s.isClosed() {
+		conn, res, err := s.dialLink(l)
+		if res != nil && res.StatusCode == http.StatusConflict && l.node {
+			s.options.Logger.Log(talklog.LevelInfo, "Skipped cluster node, it's this middleware",
+				talklog.F(talklog.KeyURL, l.url),
+			)
+			return
+		}
+		if err != nil {
+			s.options.Logger.Log(talklog.LevelWarn, "Can't connect to middleware, trying to reconnect in "+delay.String(),
+				talklog.F(talklog.KeyURL, l.url),
+				talklog.F(talklog.KeyError, err),
+			)
+			select {
+			case <-s.closed:
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > linkMaxDelay {
+				delay = linkMaxDelay
+			}
+			continue
+		}
+
+		if s.isClosed() {
+			conn.Close()
+			return
+		}
+
+		delay = linkMinDelay
+		s.options.Logger.Log(talklog.LevelInfo, "Connected to middleware",
+			talklog.F(talklog.KeyURL, l.url),
+		)
+		s.setLink(l, conn)
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				if s.isClosed() {
+					return
+				}
+				s.options.Logger.Log(talklog.LevelWarn, "Lost connection to middleware",
+					talklog.F(talklog.KeyURL, l.url),
+					talklog.F(talklog.KeyError, err),
+				)
+				break
+			}
+			s.fromLink(l, message)
+		}
+		s.setLink(l, nil)
+	}
+}
+
+// isClosed returns true if Close was called
+func (s *Server) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// dialLink connects to the other middleware of l
+func (s *Server) dialLink(l *link) (*websocket.Conn, *http.Response, error) {
+	header, err := l.authHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	if l.node {
+		header.Set(nodeHeader, s.nodeToken())
+	} else if s.options.ExtendKey != "" {
+		header.Set(childHeader, src.NewToken(s.id, []byte(s.options.ExtendKey), time.Now()))
+	}
+
+	dailer := websocket.Dialer{}
+	return dailer.Dial(l.wsURL+"/socketTalk/ws", header)
+}
+
+// isChild returns true if the session is the connection of a middleware that extends this middleware
+func isChild(sess *melody.Session) bool {
+	if sess == nil {
+		return false
+	}
+	child, ok := sess.Get(childKey)
+	return ok && child == true
+}
+
+// requestChild returns true if the request has a link token signed with Options.LinkKey
+// Only then the request comes from a middleware that extends this middleware
+func (s *Server) requestChild(r *http.Request) bool {
+	token := r.Header.Get(childHeader)
+	if token == "" || s.options.LinkKey == "" {
+		return false
+	}
+
+	key := []byte(s.options.LinkKey)
+	_, ok := src.VerifyToken(token, func(string) ([]byte, bool) {
+		return key, true
+	}, nodeTokenMaxAge)
+	return ok
+}
+
+// fromLink handles a message the other middleware of l send
+func (s *Server) fromLink(l *link, msg []byte) {
+	var meta src.SendMeta
+	err := json.Unmarshal(msg, &meta)
+	if err != nil {
+		return
+	}
+
+	if meta.Title == src.AuthFailedTitle {
+		s.options.Logger.Log(talklog.LevelError, "Middleware rejected a message, authentication failed",
+			talklog.F(talklog.KeyURL, l.url),
+		)
+		return
+	}
+	if l.node && s.presenceFromNode(l, meta) {
+		return
+	}
+	if meta.Title == src.DeliveredTitle || meta.Title == src.NotConnectedTitle {
+		// The status of a direct message this middleware forwarded, it already told the sender
+		return
+	}
+	if meta.Origin == s.id {
+		// This message started here, the sessions of this middleware already received it
+		return
+	}
+	if key, ok := dedupeKey(meta); ok && !s.seen.use(key) {
+		// The message already came in over another link
+		return
+	}
+	if !s.hop(&meta) {
+		return
+	}
+
+	msg, err = json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	s.route(msg, nil)
+}
+
+// hop raises the hop count of a message that goes from one middleware to another
+// Returns false if the message went through more than Options.MaxHops middlewares, it should be dropped
+func (s *Server) hop(meta *src.SendMeta) bool {
+	meta.Hops++
+	if meta.Hops <= s.options.MaxHops {
+		return true
+	}
+
+	s.options.Logger.Log(talklog.LevelWarn, "Dropped message that went through too many middlewares",
+		talklog.F(talklog.KeyMessageID, meta.ID),
+		talklog.F("origin", meta.Origin),
+	)
+	return false
+}
+
+// forwardUpstream sends a message to the middleware this middleware extends
+// The other nodes of the cluster don't need it, they receive the messages they subscribed to from this middleware
+func (s *Server) forwardUpstream(meta src.SendMeta) {
+	if s.upstream == nil || !s.hop(&meta) {
+		return
+	}
+
+	err := s.upstream.write(meta)
+	if err != nil {
+		s.options.Logger.Log(talklog.LevelError, "Can't send to middleware",
+			talklog.F(talklog.KeyURL, s.upstream.url),
+			talklog.F(talklog.KeyMessageID, meta.ID),
+			talklog.F(talklog.KeyError, err),
+		)
+	}
+}
+
+// setLink sets the connection of l
+// and subscribes to all titles the sessions of this middleware are subscribed to
+func (s *Server) setLink(l *link, conn *websocket.Conn) {
+	l.lock.Lock()
+	if l.conn != nil {
+		l.conn.Close()
+	}
+	l.conn = conn
+	l.lock.Unlock()
+
+	if conn != nil {
+		s.updateLink(l, src.SubscribeTitle, s.topics.list())
+	}
+	if l.node {
+		s.syncPresence(l)
+	}
+}
+
+// upstreamConnected returns true if there is a connection to the middleware this middleware extends
+func (s *Server) upstreamConnected() bool {
+	return s.upstream != nil && s.upstream.connected()
+}
+
+// updateLinks tells the other middlewares about changed subscriptions
+// title must be src.SubscribeTitle or src.UnsubscribeTitle
+func (s *Server) updateLinks(title string, keys []topicKey) {
+	if len(keys) == 0 {
+		return
+	}
+	for _, l := range s.links() {
+		s.updateLink(l, title, keys)
+	}
+}
+
+func (s *Server) updateLink(l *link, title string, keys []topicKey) {
+	if len(keys) == 0 || !l.connected() {
+		return
+	}
+
+	byGroup := map[string][]string{}
+	for _, key := range keys {
+		byGroup[key.group] = append(byGroup[key.group], key.title)
+	}
+
+	for group, topics := range byGroup {
+		l.write(src.SendMeta{
+			Title:  title,
+			Topics: topics,
+			Group:  group,
+		})
+	}
+}
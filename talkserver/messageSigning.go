@@ -0,0 +1,95 @@
+package talkserver
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// VerifyWithKey is an auth function that checks the signature of messages signed by talkclient.SignWithKey
+// Messages with a wrong signature, a timestamp that differs more than maxAge from the server time
+// or a nonce that was already used are rejected
+// If maxAge is 0 it defaults to 30 seconds
+// If the key is an empty string it will panic
+// This returns a function that can be used as Options.Auth
+func VerifyWithKey(key string, maxAge time.Duration) func(msg []byte) ([]byte, bool) {
+	if key == "" {
+		panic("VerifyWithKey key is empty")
+	}
+	if maxAge == 0 {
+		maxAge = time.Second * 30
+	}
+
+	byteKey := []byte(key)
+	nonces := newNonceList(maxAge)
+
+	return func(msg []byte) ([]byte, bool) {
+		var meta src.SendMeta
+		err := json.Unmarshal(msg, &meta)
+		if err != nil {
+			return nil, false
+		}
+
+		if !verifySignature(byteKey, meta, maxAge, nonces) {
+			return nil, false
+		}
+		return msg, true
+	}
+}
+
+// verifySignature checks the signature, timestamp and nonce of meta
+func verifySignature(key []byte, meta src.SendMeta, maxAge time.Duration, nonces *nonceList) bool {
+	if meta.Nonce == "" || !src.ValidSignature(key, meta) {
+		return false
+	}
+
+	age := time.Since(time.Unix(0, meta.Timestamp))
+	if age > maxAge || age < -maxAge {
+		return false
+	}
+
+	return nonces.use(meta.Nonce)
+}
+
+// nonceList remembers the nonces used within the max age of a message
+type nonceList struct {
+	lock      sync.Mutex
+	maxAge    time.Duration
+	used      map[string]time.Time
+	lastClean time.Time
+}
+
+func newNonceList(maxAge time.Duration) *nonceList {
+	return &nonceList{
+		maxAge:    maxAge,
+		used:      map[string]time.Time{},
+		lastClean: time.Now(),
+	}
+}
+
+// use marks nonce as used
+// Returns false if the nonce was already used
+func (n *nonceList) use(nonce string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(n.lastClean) > n.maxAge {
+		// Messages older than 2 times the max age can never be valid again
+		// so there is no need to remember their nonces
+		for key, usedAt := range n.used {
+			if now.Sub(usedAt) > n.maxAge*2 {
+				delete(n.used, key)
+			}
+		}
+		n.lastClean = now
+	}
+
+	if _, ok := n.used[nonce]; ok {
+		return false
+	}
+	n.used[nonce] = now
+	return true
+}
@@ -0,0 +1,65 @@
+package talkserver
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+func TestVerifyWithKey(t *testing.T) {
+	key := "message key"
+	verify := VerifyWithKey(key, time.Second*30)
+
+	signed := func(nonce string, timestamp time.Time, change func(meta *src.SendMeta)) []byte {
+		meta := src.SendMeta{
+			ID:        "1",
+			Title:     src.HashTitle("orders.created"),
+			Timestamp: timestamp.UnixNano(),
+			Nonce:     nonce,
+		}
+		var err error
+		meta.Signature, err = src.Sign([]byte(key), meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change != nil {
+			change(&meta)
+		}
+		msg, err := json.Marshal(meta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	msg := signed("nonce-1", time.Now(), nil)
+	if _, ok := verify(msg); !ok {
+		t.Fatal("expected a signed message to be accepted")
+	}
+	if _, ok := verify(msg); ok {
+		t.Error("expected a replayed nonce to be rejected")
+	}
+
+	if _, ok := verify(signed("nonce-2", time.Now().Add(-time.Minute), nil)); ok {
+		t.Error("expected a stale timestamp to be rejected")
+	}
+	if _, ok := verify(signed("nonce-3", time.Now().Add(time.Minute), nil)); ok {
+		t.Error("expected a timestamp in the future to be rejected")
+	}
+
+	tampered := signed("nonce-4", time.Now(), func(meta *src.SendMeta) {
+		meta.Title = src.HashTitle("orders.deleted")
+	})
+	if _, ok := verify(tampered); ok {
+		t.Error("expected a tampered title to be rejected")
+	}
+	if _, ok := verify(signed("nonce-4", time.Now(), nil)); !ok {
+		t.Error("expected the nonce of a rejected message to still be usable")
+	}
+
+	if _, ok := verify(signed("", time.Now(), nil)); ok {
+		t.Error("expected a message without nonce to be rejected")
+	}
+}
@@ -0,0 +1,115 @@
+package talkserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// broadcastBuckets are the upper bounds in seconds of the broadcast duration histogram
+var broadcastBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// metrics contains the counters shown on /socketTalk/metrics
+// All fields are updated with sync/atomic, the 64 bit fields are first so they are aligned on 32 bit platforms
+type metrics struct {
+	sessions      int64
+	framesIn      uint64
+	framesOut     uint64
+	bytesIn       uint64
+	bytesOut      uint64
+	authFailures  uint64 // Rejected by Options.Auth, Options.Registry or Options.HandshakeAuth
+	cacheHits     uint64
+	cacheMisses   uint64
+	broadcasts    uint64
+	broadcastNano uint64   // The total time of all broadcasts in nanoseconds
+	buckets       []uint64 // The amount of broadcasts per bucket of broadcastBuckets, not cumulative
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		buckets: make([]uint64, len(broadcastBuckets)),
+	}
+}
+
+// received counts an incomming frame
+func (m *metrics) received(size int) {
+	atomic.AddUint64(&m.framesIn, 1)
+	atomic.AddUint64(&m.bytesIn, uint64(size))
+}
+
+// sent counts an outgoing frame
+func (m *metrics) sent(size int) {
+	atomic.AddUint64(&m.framesOut, 1)
+	atomic.AddUint64(&m.bytesOut, uint64(size))
+}
+
+// broadcast observes how long it took to route a message to all its receivers
+func (m *metrics) broadcast(took time.Duration) {
+	atomic.AddUint64(&m.broadcasts, 1)
+	atomic.AddUint64(&m.broadcastNano, uint64(took))
+	for i, bucket := range broadcastBuckets {
+		if took.Seconds() <= bucket {
+			atomic.AddUint64(&m.buckets[i], 1)
+			break
+		}
+	}
+}
+
+// writeMetric writes one metric in the prometheus text format
+func writeMetric(out *bytes.Buffer, name string, kind string, help string, value interface{}) {
+	fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// renderMetrics returns the metrics in the prometheus text format
+func (s *Server) renderMetrics() []byte {
+	m := s.metrics
+	out := &bytes.Buffer{}
+
+	writeMetric(out, "socket_talk_sessions", "gauge", "Amount of connected websocket sessions.", atomic.LoadInt64(&m.sessions))
+	writeMetric(out, "socket_talk_frames_received_total", "counter", "Amount of websocket frames received.", atomic.LoadUint64(&m.framesIn))
+	writeMetric(out, "socket_talk_frames_sent_total", "counter", "Amount of websocket frames sent.", atomic.LoadUint64(&m.framesOut))
+	writeMetric(out, "socket_talk_received_bytes_total", "counter", "Amount of bytes received in websocket frames.", atomic.LoadUint64(&m.bytesIn))
+	writeMetric(out, "socket_talk_sent_bytes_total", "counter", "Amount of bytes sent in websocket frames.", atomic.LoadUint64(&m.bytesOut))
+	writeMetric(out, "socket_talk_auth_failures_total", "counter", "Amount of frames rejected by Options.Auth or Options.Registry and requests rejected by Options.HandshakeAuth.", atomic.LoadUint64(&m.authFailures))
+
+	stats := s.options.Store.Stats()
+	writeMetric(out, "socket_talk_cache_entries", "gauge", "Amount of payloads in the cache.", stats.Entries)
+	writeMetric(out, "socket_talk_cache_bytes", "gauge", "Size of all payloads in the cache in bytes.", stats.Bytes)
+	writeMetric(out, "socket_talk_cache_hits_total", "counter", "Amount of payloads fetched from the cache.", atomic.LoadUint64(&m.cacheHits))
+	writeMetric(out, "socket_talk_cache_misses_total", "counter", "Amount of payload fetches for an unknown ID.", atomic.LoadUint64(&m.cacheMisses))
+	writeMetric(out, "socket_talk_cache_expired_total", "counter", "Amount of payloads removed from the cache because they expired.", stats.Expired)
+
+	upstream := 0
+	if s.upstreamConnected() {
+		upstream = 1
+	}
+	writeMetric(out, "socket_talk_upstream_connected", "gauge", "1 if the connection to the middleware set in Options.ExtendURL is up.", upstream)
+
+	nodes := 0
+	for _, node := range s.nodes {
+		if node.connected() {
+			nodes++
+		}
+	}
+	writeMetric(out, "socket_talk_cluster_nodes_connected", "gauge", "Amount of other nodes of Options.Cluster this middleware is connected to.", nodes)
+
+	name := "socket_talk_broadcast_duration_seconds"
+	fmt.Fprintf(out, "# HELP %s Time it took to route a message to all its receivers.\n# TYPE %s histogram\n", name, name)
+	var cumulative uint64
+	for i, bucket := range broadcastBuckets {
+		cumulative += atomic.LoadUint64(&m.buckets[i])
+		fmt.Fprintf(out, "%s_bucket{le=\"%v\"} %d\n", name, bucket, cumulative)
+	}
+	fmt.Fprintf(out, "%s_bucket{le=\"+Inf\"} %d\n", name, atomic.LoadUint64(&m.broadcasts))
+	fmt.Fprintf(out, "%s_sum %v\n", name, time.Duration(atomic.LoadUint64(&m.broadcastNano)).Seconds())
+	fmt.Fprintf(out, "%s_count %d\n", name, atomic.LoadUint64(&m.broadcasts))
+
+	return out.Bytes()
+}
+
+// serveMetrics shows the metrics in the prometheus text format
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	writeData(w, 200, "text/plain; version=0.0.4", s.renderMetrics())
+}
@@ -0,0 +1,323 @@
+package talkserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mjarkk/socket-talk/src"
+	"github.com/mjarkk/socket-talk/talklog"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// presence keeps track of the clients that said hello
+type presence struct {
+	lock   sync.Mutex
+	peers  map[*melody.Session]src.Peer
+	byID   map[string]*melody.Session
+	remote map[*link]map[string]src.Peer // The peers of the other nodes of the cluster by the link to their node
+}
+
+func newPresence() *presence {
+	return &presence{
+		peers:  map[*melody.Session]src.Peer{},
+		byID:   map[string]*melody.Session{},
+		remote: map[*link]map[string]src.Peer{},
+	}
+}
+
+// set sets the peer of a session
+// Returns false if the client ID is used by another session and takeOver doesn't allow s to take it over
+// or if a client of another node of the cluster uses the client ID
+func (p *presence) set(s *melody.Session, peer src.Peer, takeOver func(holder *melody.Session) bool) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if holder, ok := p.byID[peer.ID]; ok && holder != s && !takeOver(holder) {
+		return false
+	}
+	for _, peers := range p.remote {
+		if _, ok := peers[peer.ID]; ok {
+			return false
+		}
+	}
+
+	if old, ok := p.peers[s]; ok && old.ID != peer.ID && p.byID[old.ID] == s {
+		delete(p.byID, old.ID)
+	}
+	p.peers[s] = peer
+	p.byID[peer.ID] = s
+	return true
+}
+
+// id returns the client ID of a session
+// Returns false if the session never said hello
+func (p *presence) id(s *melody.Session) (string, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	peer, ok := p.peers[s]
+	return peer.ID, ok
+}
+
+// session returns the session of a client ID
+func (p *presence) session(clientID string) (*melody.Session, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s, ok := p.byID[clientID]
+	return s, ok
+}
+
+// remove removes the peer of a session
+// Returns false if the session never said hello
+func (p *presence) remove(s *melody.Session) (src.Peer, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	peer, ok := p.peers[s]
+	delete(p.peers, s)
+	if ok && p.byID[peer.ID] == s {
+		delete(p.byID, peer.ID)
+	}
+	return peer, ok
+}
+
+// node returns the link to the node of the cluster a client ID is connected to
+func (p *presence) node(clientID string) (*link, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for l, peers := range p.remote {
+		if _, ok := peers[clientID]; ok {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+// setRemote replaces the peers of the node of l
+// Returns the peers that are new and the peers that are gone
+func (p *presence) setRemote(l *link, peers []src.Peer) (joined []src.Peer, left []src.Peer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	old := p.remote[l]
+	current := map[string]src.Peer{}
+	for _, peer := range peers {
+		current[peer.ID] = peer
+		if _, ok := old[peer.ID]; !ok {
+			joined = append(joined, peer)
+		}
+	}
+	for id, peer := range old {
+		if _, ok := current[id]; !ok {
+			left = append(left, peer)
+		}
+	}
+
+	if len(current) == 0 {
+		delete(p.remote, l)
+	} else {
+		p.remote[l] = current
+	}
+	return joined, left
+}
+
+// addRemote adds a peer that joined the node of l
+func (p *presence) addRemote(l *link, peer src.Peer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	peers, ok := p.remote[l]
+	if !ok {
+		peers = map[string]src.Peer{}
+		p.remote[l] = peers
+	}
+	peers[peer.ID] = peer
+}
+
+// removeRemote removes a peer that left the node of l
+func (p *presence) removeRemote(l *link, peer src.Peer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.remote[l], peer.ID)
+	if len(p.remote[l]) == 0 {
+		delete(p.remote, l)
+	}
+}
+
+// list returns the peers, the longest connected peer first
+// If withRemote is true the peers of the other nodes of the cluster are included
+func (p *presence) list(withRemote bool) []src.Peer {
+	p.lock.Lock()
+	toReturn := make([]src.Peer, 0, len(p.peers))
+	for _, peer := range p.peers {
+		toReturn = append(toReturn, peer)
+	}
+	if withRemote {
+		for _, peers := range p.remote {
+			for _, peer := range peers {
+				toReturn = append(toReturn, peer)
+			}
+		}
+	}
+	p.lock.Unlock()
+
+	sort.Slice(toReturn, func(i, j int) bool {
+		if toReturn[i].ConnectedAt != toReturn[j].ConnectedAt {
+			return toReturn[i].ConnectedAt < toReturn[j].ConnectedAt
+		}
+		return toReturn[i].ID < toReturn[j].ID
+	})
+	return toReturn
+}
+
+// hello handles the hello message of a session
+func (s *Server) hello(sess *melody.Session, peer *src.Peer) {
+	if peer == nil || len(peer.ID) == 0 {
+		return
+	}
+
+	toSet := *peer
+	toSet.ConnectedAt = time.Now().Unix()
+	if !s.presence.set(sess, toSet, func(holder *melody.Session) bool {
+		return s.sameIdentity(holder, sess)
+	}) {
+		s.options.Logger.Log(talklog.LevelWarn, "Closed session, its client ID is used by another session",
+			talklog.F("client", peer.ID),
+		)
+		sess.CloseWithMsg(melody.FormatCloseMessage(websocket.ClosePolicyViolation, "Client ID "+peer.ID+" is already connected"))
+		return
+	}
+	s.publishPresence(src.PeerJoinedTitle, toSet, sess)
+	s.sendToNodes(src.SendMeta{
+		Title: src.PeerJoinedTitle,
+		Peer:  &toSet,
+	})
+}
+
+// sameIdentity returns true if both sessions are bound to the same identity of Options.Registry
+// A client that reconnects can then take over its client ID before the middleware noticed the old connection is gone
+func (s *Server) sameIdentity(a *melody.Session, b *melody.Session) bool {
+	if s.options.Registry == nil {
+		return false
+	}
+	identityA, okA := s.identities.identity(a)
+	identityB, okB := s.identities.identity(b)
+	return okA && okB && identityA == identityB
+}
+
+// sender sets the sender of a message to the client ID of the session it came from so clients can't pretend to be another client
+// The fields middlewares set while forwarding a message are cleared so clients can't use them to skip this or fill the de-duplication window
+// Only the nodes of the cluster and the middlewares that extend this one (see Options.LinkKey) keep them
+// Returns true if meta was changed
+func (s *Server) sender(sess *melody.Session, meta *src.SendMeta) bool {
+	if isNode(sess) || isChild(sess) {
+		return false
+	}
+
+	changed := meta.Origin != "" || meta.Frame != 0 || meta.Hops != 0 || meta.Served != nil
+	meta.Origin = ""
+	meta.Frame = 0
+	meta.Hops = 0
+	meta.Served = nil
+
+	id, _ := s.presence.id(sess)
+	if meta.From != id {
+		meta.From = id
+		changed = true
+	}
+	return changed
+}
+
+// leave removes the session from the presence table when it said hello
+func (s *Server) leave(sess *melody.Session) {
+	peer, ok := s.presence.remove(sess)
+	if ok {
+		s.publishPresence(src.PeerLeftTitle, peer, sess)
+		s.sendToNodes(src.SendMeta{
+			Title: src.PeerLeftTitle,
+			Peer:  &peer,
+		})
+	}
+}
+
+// presenceFromNode handles the peers and the peer joined and left messages the node of l sends
+// Returns false if meta is not one of these messages
+func (s *Server) presenceFromNode(l *link, meta src.SendMeta) bool {
+	switch meta.Title {
+	case src.PeersTitle:
+		joined, left := s.presence.setRemote(l, meta.Peers)
+		for _, peer := range joined {
+			s.publishPresence(src.PeerJoinedTitle, peer, nil)
+		}
+		for _, peer := range left {
+			s.publishPresence(src.PeerLeftTitle, peer, nil)
+		}
+	case src.PeerJoinedTitle:
+		if meta.Peer == nil {
+			return true
+		}
+		s.presence.addRemote(l, *meta.Peer)
+		s.publishPresence(meta.Title, *meta.Peer, nil)
+	case src.PeerLeftTitle:
+		if meta.Peer == nil {
+			return true
+		}
+		s.presence.removeRemote(l, *meta.Peer)
+		s.publishPresence(meta.Title, *meta.Peer, nil)
+	default:
+		return false
+	}
+	return true
+}
+
+// syncPresence asks the node of l for its peers or, if the link is down, forgets them
+func (s *Server) syncPresence(l *link) {
+	if l.connected() {
+		l.write(src.SendMeta{Title: src.PeersTitle})
+		return
+	}
+
+	_, left := s.presence.setRemote(l, nil)
+	for _, peer := range left {
+		s.publishPresence(src.PeerLeftTitle, peer, nil)
+	}
+}
+
+// publishPresence sends a peer joined or peer left message to all sessions subscribed to title
+// The other nodes of the cluster learn about the peers with sendToNodes
+func (s *Server) publishPresence(title string, peer src.Peer, from *melody.Session) {
+	for _, d := range s.topics.deliveries(title, nil, from, true) {
+		s.send(d.session, src.SendMeta{
+			Title: title,
+			Group: d.group,
+			Peer:  &peer,
+		})
+	}
+}
+
+// sendToNodes sends meta to the other nodes of the cluster that are connected to this node
+func (s *Server) sendToNodes(meta src.SendMeta) {
+	if len(s.options.Cluster) == 0 {
+		return
+	}
+	msg, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+	s.m.BroadcastFilter(msg, isNode)
+}
+
+// servePeers lists the connected clients of all nodes of the cluster
+func (s *Server) servePeers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := s.handshakeAuth(w, r); !ok {
+		return
+	}
+	writeJSON(w, 200, s.presence.list(true))
+}
@@ -0,0 +1,39 @@
+package talkserver
+
+import (
+	"testing"
+
+	"github.com/mjarkk/socket-talk/src"
+	"gopkg.in/olahol/melody.v1"
+)
+
+func TestSender(t *testing.T) {
+	s := &Server{presence: newPresence()}
+	client := &melody.Session{}
+	s.presence.set(client, src.Peer{ID: "client"}, nil)
+	silent := &melody.Session{}
+	child := &melody.Session{Keys: map[string]interface{}{childKey: true}}
+	node := &melody.Session{Keys: map[string]interface{}{nodeKey: "node-1"}}
+
+	spoofed := func() src.SendMeta {
+		return src.SendMeta{From: "victim", Origin: "spoof", Frame: 4, Hops: 2, Served: []string{"workers"}}
+	}
+
+	for name, sess := range map[string]*melody.Session{"client": client, "session without hello": silent} {
+		meta := spoofed()
+		if !s.sender(sess, &meta) {
+			t.Errorf("%s: expected the message to be changed", name)
+		}
+		id, _ := s.presence.id(sess)
+		if meta.From != id || meta.Origin != "" || meta.Frame != 0 || meta.Hops != 0 || meta.Served != nil {
+			t.Errorf("%s: expected the sender to be set and the forwarding fields to be cleared, got %+v", name, meta)
+		}
+	}
+
+	for name, sess := range map[string]*melody.Session{"child": child, "node": node} {
+		meta := spoofed()
+		if s.sender(sess, &meta) || meta.From != "victim" || meta.Origin != "spoof" || meta.Frame != 4 || meta.Hops != 2 || len(meta.Served) != 1 {
+			t.Errorf("%s: expected the message to be kept, got %+v", name, meta)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package talkserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// ErrUnknownIdentity is returned when an identity is not in the registry
+var ErrUnknownIdentity = errors.New("Unknown identity")
+
+// HashTitle returns a title as the clients send it over the network, use this to fill ACL
+// Clients that use talkclient.Options.PlainTitles send the titles as they are
+func HashTitle(title string) string {
+	return src.HashTitle(title)
+}
+
+// ACL are the rules for the titles an identity can use
+// The titles are the hashed titles as send over the network (see HashTitle) and can contain wildcards
+type ACL struct {
+	// Allow are the titles that can be used, if empty every title that is not in Deny can be used
+	Allow []string `json:"allow,omitempty"`
+	// Deny are the titles that can't be used, this wins from Allow
+	Deny []string `json:"deny,omitempty"`
+}
+
+// allows checks if the ACL allows title
+// A title with wildcards, like a subscription, is only allowed if none of the titles it matches is denied
+// and all of them are allowed
+func (a ACL) allows(title string) bool {
+	for _, pattern := range a.Deny {
+		if src.OverlapTitles(pattern, title) {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range a.Allow {
+		if src.CoverTitle(pattern, title) {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity is a named client with its own key and rules
+type Identity struct {
+	Name      string `json:"name"`
+	Key       string `json:"key,omitempty"` // The key the client signs its messages with, see talkclient.SignAsIdentity
+	Publish   ACL    `json:"publish"`       // The titles the identity can send messages to
+	Subscribe ACL    `json:"subscribe"`     // The titles the identity can receive messages from
+}
+
+// Registry holds the identities that can use the middleware
+// Set it as Options.Registry to only accept messages signed by one of the identities
+// Identities can be added and revoked at runtime, it's safe to use from multiple goroutines
+type Registry struct {
+	lock       sync.RWMutex
+	identities map[string]Identity
+	nonces     *nonceList
+	maxAge     time.Duration
+	onChange   []func(name string)
+}
+
+// NewRegistry creates an empty registry
+// Messages with a timestamp that differs more than maxAge from the server time are rejected, if maxAge is 0 it defaults to 30 seconds
+func NewRegistry(maxAge time.Duration) *Registry {
+	if maxAge == 0 {
+		maxAge = time.Second * 30
+	}
+	return &Registry{
+		identities: map[string]Identity{},
+		nonces:     newNonceList(maxAge),
+		maxAge:     maxAge,
+	}
+}
+
+// Set adds an identity or replaces the identity with the same name
+// The connected sessions of a replaced identity are disconnected,
+// the subscriptions they made under the old rules are dropped and they have to reconnect with the new rules
+func (r *Registry) Set(identity Identity) error {
+	if identity.Name == "" {
+		return errors.New("Identity name is empty")
+	}
+	if identity.Key == "" {
+		return errors.New("Identity key is empty")
+	}
+
+	r.lock.Lock()
+	_, replaced := r.identities[identity.Name]
+	r.identities[identity.Name] = identity
+	onChange := r.onChange
+	r.lock.Unlock()
+
+	if replaced {
+		for _, fn := range onChange {
+			fn(identity.Name)
+		}
+	}
+	return nil
+}
+
+// Revoke removes an identity and disconnects all its sessions
+func (r *Registry) Revoke(name string) error {
+	r.lock.Lock()
+	_, ok := r.identities[name]
+	delete(r.identities, name)
+	onChange := r.onChange
+	r.lock.Unlock()
+
+	if !ok {
+		return ErrUnknownIdentity
+	}
+	for _, fn := range onChange {
+		fn(name)
+	}
+	return nil
+}
+
+// Get returns an identity
+func (r *Registry) Get(name string) (Identity, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	identity, ok := r.identities[name]
+	return identity, ok
+}
+
+// List returns all identities sorted by name, the keys are left out
+func (r *Registry) List() []Identity {
+	r.lock.RLock()
+	toReturn := make([]Identity, 0, len(r.identities))
+	for _, identity := range r.identities {
+		identity.Key = ""
+		toReturn = append(toReturn, identity)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(toReturn, func(i, j int) bool {
+		return toReturn[i].Name < toReturn[j].Name
+	})
+	return toReturn
+}
+
+// notifyChange calls fn every time an identity is replaced or revoked
+func (r *Registry) notifyChange(fn func(name string)) {
+	r.lock.Lock()
+	r.onChange = append(r.onChange, fn)
+	r.lock.Unlock()
+}
+
+// verify checks the signature of meta with the key of its identity
+// Returns the identity if the message is valid
+func (r *Registry) verify(meta src.SendMeta) (Identity, bool) {
+	identity, ok := r.Get(meta.Identity)
+	if !ok {
+		return Identity{}, false
+	}
+
+	if !verifySignature([]byte(identity.Key), meta, r.maxAge, r.nonces) {
+		return Identity{}, false
+	}
+	return identity, true
+}
+
+// sessionIdentities keeps track of the identity every session uses
+type sessionIdentities struct {
+	lock       sync.Mutex
+	identities map[*melody.Session]string
+}
+
+func newSessionIdentities() *sessionIdentities {
+	return &sessionIdentities{
+		identities: map[*melody.Session]string{},
+	}
+}
+
+// bind binds a session to identity
+// Returns false if the session is already bound to another identity
+func (s *sessionIdentities) bind(sess *melody.Session, identity string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current, ok := s.identities[sess]
+	if ok {
+		return current == identity
+	}
+	s.identities[sess] = identity
+	return true
+}
+
+// remove forgets a session
+func (s *sessionIdentities) remove(sess *melody.Session) {
+	s.lock.Lock()
+	delete(s.identities, sess)
+	s.lock.Unlock()
+}
+
+// identity returns the identity a session is bound to
+func (s *sessionIdentities) identity(sess *melody.Session) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	identity, ok := s.identities[sess]
+	return identity, ok
+}
+
+// sessions returns all sessions bound to identity
+func (s *sessionIdentities) sessions(identity string) []*melody.Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	toReturn := []*melody.Session{}
+	for sess, name := range s.identities {
+		if name == identity {
+			toReturn = append(toReturn, sess)
+		}
+	}
+	return toReturn
+}
+
+// authorize checks if the session can send meta
+// With a registry every message must be signed by an identity and the session can only use that identity
+// Subscribe messages lose the topics the identity can't subscribe to
+func (s *Server) authorize(sess *melody.Session, meta *src.SendMeta) bool {
+	registry := s.options.Registry
+	if registry == nil {
+		return true
+	}
+
+	identity, ok := registry.verify(*meta)
+	if !ok || !s.identities.bind(sess, identity.Name) {
+		return false
+	}
+
+	switch meta.Title {
+	case src.SubscribeTitle:
+		if isAnswerSubscription(*meta) {
+			// The client wants to receive the answers to a message it sends
+			return identity.Publish.allows(meta.ReplyTo)
+		}
+
+		allowed := []string{}
+		for _, title := range meta.Topics {
+			if title == src.PeerJoinedTitle || title == src.PeerLeftTitle || identity.Subscribe.allows(title) {
+				allowed = append(allowed, title)
+			}
+		}
+		meta.Topics = allowed
+		return true
+	case src.UnsubscribeTitle, src.HelloTitle, src.PeersTitle:
+		return true
+	default:
+		if isAnswer(*meta) {
+			// Answering a message is allowed if the identity could receive the message
+			return identity.Subscribe.allows(meta.ReplyTo)
+		}
+		return identity.Publish.allows(meta.Title)
+	}
+}
+
+// isAnswer returns true if meta is an answer to the message with the title meta.ReplyTo
+func isAnswer(meta src.SendMeta) bool {
+	return len(meta.ReplyTo) > 0 && meta.Title == src.Hash(meta.ReplyTo+meta.ID)
+}
+
+// isAnswerSubscription returns true if meta subscribes to the answers of the message with the title meta.ReplyTo
+func isAnswerSubscription(meta src.SendMeta) bool {
+	return len(meta.ReplyTo) > 0 && len(meta.Topics) == 1 && meta.Topics[0] == src.Hash(meta.ReplyTo+meta.ID)
+}
+
+// disconnectIdentity disconnects all sessions of an identity
+// It's called when the identity is revoked or replaced as the sessions might use subscriptions the identity can't make anymore
+func (s *Server) disconnectIdentity(name string) {
+	for _, sess := range s.identities.sessions(name) {
+		sess.Close()
+	}
+}
+
+// serveAdmin handles the routes to manage the identities of the registry, path is the path after /socketTalk/admin/
+// All routes need the header "Authorization: Bearer <Options.AdminKey>"
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request, path string) {
+	key := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if subtle.ConstantTimeCompare(key, []byte(s.options.AdminKey)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	registry := s.options.Registry
+	if path == "identities" {
+		handle(w, r, "GET", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, 200, registry.List())
+		})
+		return
+	}
+
+	name := strings.TrimPrefix(path, "identities/")
+	if name == path || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		var identity Identity
+		err := json.NewDecoder(r.Body).Decode(&identity)
+		if err != nil {
+			writeString(w, 400, err.Error())
+			return
+		}
+
+		identity.Name = name
+		err = registry.Set(identity)
+		if err != nil {
+			writeString(w, 400, err.Error())
+			return
+		}
+		w.WriteHeader(204)
+	case "DELETE":
+		err := registry.Revoke(name)
+		if err == ErrUnknownIdentity {
+			writeString(w, 404, err.Error())
+			return
+		}
+		w.WriteHeader(204)
+	default:
+		w.Header().Set("Allow", "PUT, DELETE")
+		writeString(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	}
+}
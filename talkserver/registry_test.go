@@ -0,0 +1,52 @@
+package talkserver
+
+import "testing"
+
+func TestACLAllows(t *testing.T) {
+	hashed := func(titles ...string) []string {
+		toReturn := []string{}
+		for _, title := range titles {
+			toReturn = append(toReturn, HashTitle(title))
+		}
+		return toReturn
+	}
+
+	tests := []struct {
+		name   string
+		acl    ACL
+		title  string
+		allows bool
+	}{
+		{"empty acl", ACL{}, "orders.created", true},
+		{"empty acl wildcard", ACL{}, ">", true},
+
+		{"deny exact", ACL{Deny: hashed("admin.secrets")}, "admin.secrets", false},
+		{"deny other title", ACL{Deny: hashed("admin.secrets")}, "admin.users", true},
+		{"deny single wildcard subscription", ACL{Deny: hashed("admin.secrets")}, "admin.*", false},
+		{"deny multi wildcard subscription", ACL{Deny: hashed("admin.secrets")}, "admin.>", false},
+		{"deny wildcard levels subscription", ACL{Deny: hashed("admin.secrets")}, "*.*", false},
+		{"deny wildcard with other level count", ACL{Deny: hashed("admin.secrets")}, "*", true},
+		{"deny wildcard rule", ACL{Deny: hashed("admin.>")}, "admin.users", false},
+		{"deny wildcard rule everything", ACL{Deny: hashed("admin.>")}, ">", false},
+		{"deny wildcard rule first level", ACL{Deny: hashed("admin.>")}, "*.x", false},
+		{"deny wildcard rule other title", ACL{Deny: hashed("admin.>")}, "orders.*", true},
+
+		{"allow exact", ACL{Allow: hashed("invoice.created")}, "invoice.created", true},
+		{"allow other title", ACL{Allow: hashed("invoice.created")}, "invoice.paid", false},
+		{"allow wider subscription", ACL{Allow: hashed("invoice.created")}, "invoice.*", false},
+		{"allow wildcard rule", ACL{Allow: hashed("invoice.>")}, "invoice.paid", true},
+		{"allow wildcard rule subscription", ACL{Allow: hashed("invoice.>")}, "invoice.*", true},
+		{"allow wildcard rule wider subscription", ACL{Allow: hashed("invoice.>")}, ">", false},
+		{"allow wildcard rule other first level", ACL{Allow: hashed("invoice.>")}, "*.paid", false},
+
+		{"deny wins", ACL{Allow: hashed("invoice.>"), Deny: hashed("invoice.secret")}, "invoice.secret", false},
+		{"deny wins from wildcard", ACL{Allow: hashed("invoice.>"), Deny: hashed("invoice.secret")}, "invoice.*", false},
+		{"deny leaves others", ACL{Allow: hashed("invoice.>"), Deny: hashed("invoice.secret")}, "invoice.paid", true},
+	}
+
+	for _, test := range tests {
+		if allows := test.acl.allows(HashTitle(test.title)); allows != test.allows {
+			t.Errorf("%s: allows(%q) = %v, expected %v", test.name, test.title, allows, test.allows)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package talkserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// routePrefix is the path all routes of the middleware are under
+const routePrefix = "/socketTalk/"
+
+// ServeHTTP handles the routes of the middleware
+// Everything in the path before /socketTalk/ is ignored so the server can be mounted under any prefix
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	i := strings.Index(r.URL.Path, routePrefix)
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	path := r.URL.Path[i+len(routePrefix):]
+
+	switch {
+	case path == "ws":
+		handle(w, r, "GET", s.serveWS)
+	case path == "set":
+		handle(w, r, "POST", s.serveSet)
+	case path == "get":
+		handle(w, r, "POST", s.serveGet)
+	case path == "peers":
+		handle(w, r, "GET", s.servePeers)
+	case path == "metrics" && s.options.Metrics:
+		handle(w, r, "GET", s.serveMetrics)
+	case strings.HasPrefix(path, "admin/") && s.options.Registry != nil && len(s.options.AdminKey) > 0:
+		s.serveAdmin(w, r, strings.TrimPrefix(path, "admin/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handle calls handler if the request uses method
+func handle(w http.ResponseWriter, r *http.Request, method string, handler http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeString(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	handler(w, r)
+}
+
+// writeString responds with a plain text body
+func writeString(w http.ResponseWriter, status int, body string) {
+	writeData(w, status, "text/plain; charset=utf-8", []byte(body))
+}
+
+// writeData responds with body
+func writeData(w http.ResponseWriter, status int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeJSON responds with the json of v
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeString(w, 500, err.Error())
+		return
+	}
+	writeData(w, status, "application/json; charset=utf-8", body)
+}
@@ -1,27 +1,33 @@
 package talkserver
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"log"
 	"net/http"
-	"strings"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"github.com/mjarkk/socket-talk/src"
+	"github.com/mjarkk/socket-talk/talklog"
 	uuid "github.com/satori/go.uuid"
 	"gopkg.in/olahol/melody.v1"
 )
 
-// Options are some settings to include in the Setup function
+// Options are some settings to include in the Setup or New function
 type Options struct {
-	// Auth validates the request, if this is not defined it will broadcast every message
+	// HandshakeAuth validates the token of a client before its websocket connection is accepted
+	// The same token is checked on the cache and peers routes, requests without a valid token get 401 Unauthorized
+	// The token is read from the header "Authorization: Bearer <token>" or the query parameter token
+	// The returned identity binds the session to an identity of Registry, it can be empty
+	// Use VerifyToken or Registry.VerifyToken, if this is not defined every connection will be accepted
+	HandshakeAuth func(token string) (identity string, ok bool)
+
+	// Auth validates the request, if this is not defined every message will be accepted
 	// The function it's argument is the message that websocket reciefed
-	// The return values are the message that gets send to all other client
+	// The return values are the message that gets send to the subscribed clients
 	// And a bool that tells if the Auth was correct
 	Auth func(msg []byte) ([]byte, bool)
 
@@ -30,11 +36,115 @@ type Options struct {
 	SendKeepAlive bool
 
 	// if ExtendURL is spesified the middleware will extends another middleware
+	// One connection to that middleware is kept open and reconnected when it drops,
+	// messages and subscriptions of this middleware are send over it and the messages of the other middleware come back over it
 	ExtendURL   string
 	ExtendWSURL string
+
+	// ExtendToken returns the token this middleware connects with to the middleware of ExtendURL if that one uses HandshakeAuth
+	// It's called for every (re)connect, use talkclient.TokenWithKey or talkclient.TokenAsIdentity
+	ExtendToken func() (string, error)
+
+	// ExtendAuth changes every message before it's send to the middleware of ExtendURL
+	// Use this to sign the messages if that middleware uses Auth
+	ExtendAuth func(msg []byte) []byte
+
+	// ExtendKey is the LinkKey of the middleware of ExtendURL
+	// Without it that middleware treats this middleware as a client and replaces the sender of the forwarded messages
+	ExtendKey string
+
+	// LinkKey is the key the middlewares that extend this middleware prove they are a middleware with, they set it as ExtendKey
+	// Only connections with a link token signed with this key can forward messages in the name of their own clients
+	LinkKey string
+
+	// Cluster are the URLs of the other nodes of the cluster this middleware is part of
+	// The nodes work as one middleware, clients connected to different nodes can talk to each other and payloads can be fetched from every node
+	// Every node keeps a connection open to every other node, the URL of this node itself can be in the list
+	Cluster []string
+
+	// ClusterKey is the key the nodes of Cluster prove to each other they are a node with, all nodes need the same key
+	// Only connections with a node token signed with this key are treated as a node, this is required when Cluster is set
+	ClusterKey string
+
+	// ClusterToken returns the token this middleware connects with to the other nodes of Cluster if they use HandshakeAuth
+	ClusterToken func() (string, error)
+
+	// ClusterAuth changes every message before it's send to the other nodes of Cluster
+	// Use this to sign the messages if the nodes use Auth
+	ClusterAuth func(msg []byte) []byte
+
+	// MaxHops is the max amount of middlewares a message is forwarded to, default: 8
+	// Together with the ID of the middleware a message started at this prevents messages from going around in circles
+	MaxHops int
+
+	// MaxMessageSize is the max size in bytes of a websocket message, default: 65536
+	// Sessions that send a larger message are closed, the clients need a lower talkclient.Options.InlineThreshold when this is lowered
+	MaxMessageSize int64
+
+	// Store is where the payloads of messages are kept until they are fetched, default: NewMemoryStore()
+	// Use NewDiskStore to keep large payloads out of memory or implement Store to use your own backend
+	// Close only closes the default store, a store set here can be shared and has to be closed by its owner
+	Store Store
+
+	// CacheTTL is how long a payload is kept in the cache, default: 20 seconds
+	CacheTTL time.Duration
+
+	// MaxCacheEntrySize is the max size in bytes of a single payload, 0 means no limit
+	// Larger payloads are rejected with 413 Request Entity Too Large
+	MaxCacheEntrySize int64
+
+	// MaxCacheSize is the max size in bytes of all payloads together, 0 means no limit
+	// If a new payload doesn't fit the oldest payloads are removed
+	// Payloads larger than this are rejected with 507 Insufficient Storage
+	MaxCacheSize int64
+
+	// CacheReads is the amount of times a payload can be fetched before it's removed, 0 means no limit
+	// Set this to ExpectedReaders to remove a payload once every session the message was routed to has fetched it,
+	// ExpectedReaders doesn't work together with ExtendURL and Cluster as this middleware can't know who reads the payloads
+	CacheReads int
+
+	// Registry contains the identities that can use the middleware, if set every message must be signed by one of them
+	// The rules of the identity decide what titles a session can send messages to and subscribe to
+	// Auth is checked before the registry, most of the time only one of them is used
+	Registry *Registry
+
+	// AdminKey enables the routes under /socketTalk/admin to manage the identities of Registry at runtime
+	// Requests to these routes need the header "Authorization: Bearer <AdminKey>"
+	AdminKey string
+
+	// Logger receives structured log entries about the connection to ExtendURL and the routed messages
+	// Use talklog.NewStdLogger or talklog.NewJSONLogger or implement talklog.Logger
+	// default: info and higher are written to stdout
+	Logger talklog.Logger
+
+	// Metrics adds the route /socketTalk/metrics that shows metrics about the middleware in the prometheus text format
+	Metrics bool
+}
+
+// Server is a middleware, it implements http.Handler
+type Server struct {
+	frames     uint64 // The last frame number given to a message, see stamp, first so it's aligned for sync/atomic on 32 bit platforms
+	id         string // Send along with the messages this middleware forwards to recognize them when they come back
+	m          *melody.Melody
+	options    *Options
+	topics     *topics
+	cache      *cache
+	presence   *presence
+	metrics    *metrics
+	identities *sessionIdentities
+	seen       *nonceList // The messages received from other middlewares, see dedupeKey
+
+	upstream *link   // The middleware this middleware extends
+	nodes    []*link // The other nodes of the cluster
+
+	ownStore *MemoryStore // The default store New created, it's closed by Close
+
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
 // Setup sets up the needed routes and sets up the websocket route
+// It mounts the server of New on the gin engine under /socketTalk
 func Setup(r *gin.Engine, o ...Options) {
 	var options Options
 	switch len(o) {
@@ -46,182 +156,364 @@ func Setup(r *gin.Engine, o ...Options) {
 		panic("Setup accepts only 1 options argument")
 	}
 
-	m := melody.New()
-	r.GET("/socketTalk/ws", func(c *gin.Context) {
-		m.HandleRequest(c.Writer, c.Request)
-	})
+	r.Any(routePrefix+"*path", gin.WrapH(New(options)))
+}
+
+// New creates a middleware
+// The returned server is a http.Handler that handles all routes under /socketTalk/,
+// mount it on any router with or without a path prefix, the clients then use the prefix as part of their ServerURL:
+//
+//	http.Handle("/socketTalk/", talkserver.New(options))
+//	http.Handle("/bus/socketTalk/", talkserver.New(options)) // ServerURL: "https://example.com/bus"
+func New(options Options) *Server {
+	if options.MaxMessageSize == 0 {
+		options.MaxMessageSize = 65536
+	}
+	var ownStore *MemoryStore
+	if options.Store == nil {
+		ownStore = NewMemoryStore()
+		options.Store = ownStore
+	}
+	if options.Logger == nil {
+		options.Logger = talklog.NewStdLogger(log.New(os.Stdout, "", log.LstdFlags), talklog.LevelInfo)
+	}
+	if len(options.Cluster) > 0 && options.ClusterKey == "" {
+		panic("Cluster needs a ClusterKey")
+	}
+	if options.MaxHops == 0 {
+		options.MaxHops = 8
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		panic("Can't create a server ID, error: " + err.Error())
+	}
+
+	s := &Server{
+		id:         id.String(),
+		m:          melody.New(),
+		options:    &options,
+		topics:     newTopics(),
+		cache:      newCache(&options),
+		presence:   newPresence(),
+		metrics:    newMetrics(),
+		identities: newSessionIdentities(),
+		seen:       newNonceList(dedupeWindow),
+		ownStore:   ownStore,
+		closed:     make(chan struct{}),
+	}
+	s.m.Config.MaxMessageSize = options.MaxMessageSize
 
 	if len(options.ExtendURL) > 0 {
-		options.ExtendWSURL = strings.Replace(strings.Replace(options.ExtendURL, "https:", "wss:", -1), "http:", "ws:", -1)
-		go func() {
-			firstRun := true
-			for {
-				dailer := websocket.Dialer{}
-				conn, _, err := dailer.Dial(options.ExtendWSURL+"/socketTalk/ws", nil)
-				if err != nil {
-					if firstRun {
-						panic("Can't connect to other middleware, error: " + err.Error())
-					}
-					fmt.Println("can't connect to middleware, trying to reconnect in 4 seconds, error:", err)
-					time.Sleep(time.Second * 4)
-				}
-				firstRun = false
-				_, message, err := conn.ReadMessage()
-				if err != nil {
-					fmt.Println("Read error:", err)
-					continue
-				}
+		s.upstream = newLink(options.ExtendURL, false, options.ExtendToken, options.ExtendAuth)
+		options.ExtendWSURL = s.upstream.wsURL
+	}
+	for _, url := range options.Cluster {
+		s.nodes = append(s.nodes, newLink(url, true, options.ClusterToken, options.ClusterAuth))
+	}
+	for _, l := range s.links() {
+		go s.linkLoop(l)
+	}
 
-				m.Broadcast(message)
-			}
-		}()
+	if options.Registry != nil {
+		options.Registry.notifyChange(s.disconnectIdentity)
 	}
+	s.handleMessages()
+	go keepAlive(s.m, &options)
+	return s
+}
 
-	setupCache(r, &options)
-	handleMessages(m, &options)
-	go keepAlive(m, &options)
+// Close disconnects all clients and the connections to other middlewares and stops the default store
+// Use it after http.Server.Shutdown as that doesn't close websocket connections
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		for _, l := range s.links() {
+			s.setLink(l, nil)
+		}
+		err = s.m.Close()
+		if s.ownStore != nil {
+			s.ownStore.Close()
+		}
+	})
+	return err
 }
 
-func handleMessages(m *melody.Melody, o *Options) {
-	m.HandleMessage(func(s *melody.Session, msg []byte) {
-		defer func() {
-			if len(o.ExtendURL) > 0 {
-				dailer := websocket.Dialer{}
-				conn, _, err := dailer.Dial(o.ExtendWSURL+"/socketTalk/ws", nil)
-				if err != nil {
-					fmt.Println("Can't send to middleware, error:", err)
-					return
-				}
-				conn.WriteMessage(1, msg)
-				conn.Close()
+// serveWS upgrades the request to the websocket connection of a client
+func (s *Server) serveWS(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.handshakeAuth(w, r)
+	if !ok {
+		return
+	}
+
+	node := s.requestNode(r)
+	if node == s.id {
+		// This middleware is in its own cluster list
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	s.m.HandleRequestWithKeys(w, r, map[string]interface{}{
+		identityKey: identity,
+		nodeKey:     node,
+		childKey:    node == "" && s.requestChild(r),
+	})
+}
+
+func (s *Server) handleMessages() {
+	s.m.HandleConnect(func(sess *melody.Session) {
+		atomic.AddInt64(&s.metrics.sessions, 1)
+		if identity, ok := sess.Get(identityKey); ok && identity != nil && identity != "" {
+			s.identities.bind(sess, identity.(string))
+		}
+	})
+
+	s.m.HandleDisconnect(func(sess *melody.Session) {
+		atomic.AddInt64(&s.metrics.sessions, -1)
+		s.leave(sess)
+		s.identities.remove(sess)
+		s.updateLinks(src.UnsubscribeTitle, s.topics.remove(sess))
+	})
+
+	s.m.HandleMessage(func(sess *melody.Session, msg []byte) {
+		size := len(msg)
+		s.metrics.received(size)
+
+		if s.options.Auth != nil {
+			var ok bool
+			msg, ok = s.options.Auth(msg)
+			if !ok {
+				atomic.AddUint64(&s.metrics.authFailures, 1)
+				s.options.Logger.Log(talklog.LevelWarn, "Message rejected, authentication failed",
+					talklog.F(talklog.KeyDirection, talklog.DirectionReceive),
+					talklog.F(talklog.KeySize, size),
+				)
+				s.send(sess, src.SendMeta{
+					Title: src.AuthFailedTitle,
+				})
+				return
 			}
-		}()
+		}
 
-		if o.Auth == nil {
-			m.BroadcastOthers(msg, s)
+		var meta src.SendMeta
+		err := json.Unmarshal(msg, &meta)
+		if err != nil {
+			return
+		}
+		if meta.Origin == s.id {
+			// This middleware forwarded this message, it went around in a circle
 			return
 		}
 
-		msg, ok := o.Auth(msg)
-		if !ok {
-			send(s, src.SendMeta{
-				Title: src.Hash("SOCKET_TALK_AUTH_FAILED"),
+		if !s.authorize(sess, &meta) {
+			atomic.AddUint64(&s.metrics.authFailures, 1)
+			s.options.Logger.Log(talklog.LevelWarn, "Message rejected, identity not allowed",
+				talklog.F(talklog.KeyDirection, talklog.DirectionReceive),
+				talklog.F(talklog.KeySize, size),
+				talklog.F("identity", meta.Identity),
+			)
+			s.send(sess, src.SendMeta{
+				Title: src.AuthFailedTitle,
 			})
 			return
 		}
 
-		m.BroadcastOthers(msg, s)
+		switch meta.Title {
+		case src.SubscribeTitle:
+			added := []topicKey{}
+			for _, title := range meta.Topics {
+				key := topicKey{title, meta.Group}
+				if s.topics.subscribe(sess, key) {
+					added = append(added, key)
+				}
+			}
+			s.updateLinks(src.SubscribeTitle, added)
+		case src.UnsubscribeTitle:
+			removed := []topicKey{}
+			for _, title := range meta.Topics {
+				key := topicKey{title, meta.Group}
+				if s.topics.unsubscribe(sess, key) {
+					removed = append(removed, key)
+				}
+			}
+			s.updateLinks(src.UnsubscribeTitle, removed)
+		case src.HelloTitle:
+			s.hello(sess, meta.Peer)
+		case src.PeersTitle:
+			// Another node of the cluster only needs the peers of this node
+			s.send(sess, src.SendMeta{
+				Title: src.PeersTitle,
+				ID:    meta.ID,
+				Peers: s.presence.list(!isNode(sess)),
+			})
+		case src.PeerJoinedTitle, src.PeerLeftTitle, src.AuthFailedTitle, src.DeliveredTitle, src.NotConnectedTitle:
+			// Only the server sends these messages
+		default:
+			if s.sender(sess, &meta) {
+				msg, err = json.Marshal(meta)
+				if err != nil {
+					return
+				}
+			}
+			if len(meta.To) > 0 {
+				status := src.NotConnectedTitle
+				if s.routeDirect(msg, meta) || (!isNode(sess) && s.forwardDirect(meta)) {
+					status = src.DeliveredTitle
+				}
+				s.send(sess, src.SendMeta{
+					Title: status,
+					ID:    meta.ID,
+					To:    meta.To,
+				})
+				return
+			}
+			if s.clustered() && meta.Origin == "" {
+				s.stamp(&meta)
+				msg, err = json.Marshal(meta)
+				if err != nil {
+					return
+				}
+			}
+			meta.Served = append(meta.Served, s.route(msg, sess)...)
+			s.forwardUpstream(meta)
+		}
 	})
 }
 
-func keepAlive(m *melody.Melody, o *Options) {
-	if o.SendKeepAlive {
-		for {
-			// A keep alive message that makes sure the clients stay connected
-			// This bypasses the timeout on proxyies
-			time.Sleep(time.Second * 30)
-			m.Broadcast([]byte("🤖️"))
-		}
+// route sends msg to all sessions that are subscribed to the title of msg
+// of every queue group subscribed to the title only one session receives msg
+// from is the session that send the message, it will not receive the message itself
+// If from is nil the message comes from another middleware,
+// it already chose the group the message is for so only the sessions subscribed with that group get the message
+// Messages from other middlewares and the nodes of the cluster are not routed to the nodes of the cluster
+// The queue groups in meta.Served already received the message on another middleware, they are skipped
+// Returns the queue groups that received the message
+func (s *Server) route(msg []byte, from *melody.Session) []string {
+	var meta src.SendMeta
+	err := json.Unmarshal(msg, &meta)
+	if err != nil {
+		return nil
 	}
-}
 
-var cacheLock sync.RWMutex
-var cache = map[string][]byte{}
-
-type getCachePost struct {
-	ID string `json:"ID"`
-}
-
-func addToCache(toAdd []byte) (string, error) {
-	uuid, err := uuid.NewV4()
-	if err != nil {
-		return "", err
+	if len(meta.To) > 0 {
+		s.routeDirect(msg, meta)
+		return nil
 	}
-	id := src.Hash(uuid.String())
 
-	cacheLock.Lock()
-	cache[id] = toAdd
-	cacheLock.Unlock()
+	var only *string
+	if from == nil {
+		only = &meta.Group
+	}
+	start := time.Now()
+	deliveries := []delivery{}
+	served := []string{}
+	for _, d := range s.topics.deliveries(meta.Title, only, from, from == nil || isNode(from)) {
+		if d.group != "" {
+			if containsString(meta.Served, d.group) {
+				continue
+			}
+			served = append(served, d.group)
+		}
+		deliveries = append(deliveries, d)
+	}
 
-	go func(id string) {
-		time.Sleep(time.Second * 20)
+	if !s.clustered() {
+		s.cache.expectReads(meta.MessageID, len(deliveries))
+	}
 
-		cacheLock.Lock()
-		delete(cache, id)
-		cacheLock.Unlock()
+	for _, d := range deliveries {
+		if d.group == meta.Group {
+			s.write(d.session, msg)
+			continue
+		}
 
-	}(id)
+		// Tell the client for what group it received the message
+		groupMeta := meta
+		groupMeta.Group = d.group
+		s.send(d.session, groupMeta)
+	}
 
-	return id, nil
+	took := time.Since(start)
+	s.metrics.broadcast(took)
+	title := meta.Title
+	if meta.TitleHint != "" {
+		title = meta.TitleHint
+	}
+	s.options.Logger.Log(talklog.LevelDebug, "Routed message",
+		talklog.F(talklog.KeyTitle, title),
+		talklog.F(talklog.KeyMessageID, meta.ID),
+		talklog.F(talklog.KeyDirection, talklog.DirectionReceive),
+		talklog.F(talklog.KeySize, len(msg)),
+		talklog.F(talklog.KeyDuration, took),
+		talklog.F("receivers", len(deliveries)),
+	)
+	return served
 }
 
-func proxy(c *gin.Context, url string) {
-	req, err := http.NewRequest("POST", url, c.Request.Body)
-	if err != nil {
-		c.String(400, "CACHE SET PROXY ERROR: "+err.Error())
+// containsString returns true if list contains item
+func containsString(list []string, item string) bool {
+	for _, listItem := range list {
+		if listItem == item {
+			return true
+		}
 	}
+	return false
+}
 
-	client := &http.Client{}
-	res, err := client.Do(req)
-	if err != nil {
-		c.String(400, "CACHE SET PROXY ERROR: "+err.Error())
+// routeDirect sends msg only to the session of the client meta.To
+// Returns false if that client is not connected to this middleware
+func (s *Server) routeDirect(msg []byte, meta src.SendMeta) bool {
+	sess, ok := s.presence.session(meta.To)
+	if !ok {
+		return false
 	}
 
-	rawOut, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		c.String(400, "CACHE SET PROXY ERROR: "+err.Error())
+	if !s.clustered() {
+		s.cache.expectReads(meta.MessageID, 1)
 	}
-
-	c.Data(res.StatusCode, "text/plain", rawOut)
+	return s.write(sess, msg) == nil
 }
 
-func setupCache(r *gin.Engine, o *Options) {
-	r.POST("/socketTalk/set", func(c *gin.Context) {
-		if len(o.ExtendURL) > 0 {
-			proxy(c, o.ExtendURL+"/socketTalk/set")
-		} else {
-			buf := new(bytes.Buffer)
-			buf.ReadFrom(c.Request.Body)
-			id, err := addToCache(buf.Bytes())
-			if err != nil {
-				c.String(400, err.Error())
-				return
-			}
-			c.String(200, id)
-		}
-	})
-
-	r.POST("/socketTalk/get", func(c *gin.Context) {
-		if len(o.ExtendURL) > 0 {
-			proxy(c, o.ExtendURL+"/socketTalk/get")
-		} else {
-			var data getCachePost
-			err := c.ShouldBindJSON(&data)
-			if err != nil {
-				c.String(400, err.Error())
-				return
-			}
-
-			cacheLock.Lock()
-			cacheItem, ok := cache[data.ID]
-			cacheLock.Unlock()
+// forwardDirect sends a direct message to the node of the cluster the client meta.To is connected to
+// Returns false if that client is not connected to one of the nodes
+func (s *Server) forwardDirect(meta src.SendMeta) bool {
+	l, ok := s.presence.node(meta.To)
+	if !ok || !s.hop(&meta) {
+		return false
+	}
+	return l.write(meta) == nil
+}
 
-			if !ok {
-				c.String(400, "ID is wrong")
+func keepAlive(m *melody.Melody, o *Options) {
+	if o.SendKeepAlive {
+		for {
+			// A keep alive message that makes sure the clients stay connected
+			// This bypasses the timeout on proxyies
+			time.Sleep(time.Second * 30)
+			if m.IsClosed() {
 				return
 			}
-
-			c.Data(200, "text/plain", cacheItem)
+			m.Broadcast([]byte("🤖️"))
 		}
-	})
+	}
 }
 
 // send sends something to a spesific object
-func send(s *melody.Session, toSend interface{}) error {
+func (s *Server) send(sess *melody.Session, toSend interface{}) error {
 	meta, err := json.Marshal(toSend)
 	if err != nil {
 		return err
 	}
 
-	return s.Write(meta)
+	return s.write(sess, meta)
+}
+
+// write writes msg to a session
+func (s *Server) write(sess *melody.Session, msg []byte) error {
+	err := sess.Write(msg)
+	if err == nil {
+		s.metrics.sent(len(msg))
+	}
+	return err
 }
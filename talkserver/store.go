@@ -0,0 +1,365 @@
+package talkserver
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjarkk/socket-talk/src"
+)
+
+// ErrNotFound is returned by a Store if there is no (not expired) entry for an ID
+var ErrNotFound = errors.New("ID is wrong")
+
+// StoreStats are statistics about the entries of a Store
+type StoreStats struct {
+	Entries int    // The amount of entries currently in the store
+	Bytes   int64  // The total size of all entries currently in the store
+	Expired uint64 // The amount of entries that expired since the store was created
+}
+
+// Store stores the payloads of messages until the receivers have fetched them
+// A Store must be safe to use from multiple goroutines
+type Store interface {
+	// Put adds data to the store, after ttl the entry should be removed
+	Put(id string, data []byte, ttl time.Duration) error
+	// Get returns the data of an entry, if there is no entry ErrNotFound should be returned
+	Get(id string) ([]byte, error)
+	// Delete removes an entry, deleting an entry that doesn't exist is not an error
+	Delete(id string) error
+	// Stats returns statistics about the store
+	Stats() StoreStats
+}
+
+// expirer is implemented by the built in stores
+// expire removes an entry that expired before the cleanup of the store did and counts it in StoreStats.Expired
+type expirer interface {
+	expire(id string) error
+}
+
+// cleanupInterval is how often the built in stores remove expired entries
+const cleanupInterval = time.Second
+
+type memoryEntry struct {
+	data    []byte
+	expires time.Time
+}
+
+// MemoryStore is a Store that keeps all entries in memory
+type MemoryStore struct {
+	lock    sync.RWMutex
+	entries map[string]memoryEntry
+	bytes   int64
+	expired uint64
+	stop    *stopper
+}
+
+// NewMemoryStore creates a new in memory store
+// Call Close when the store is no longer used to stop removing the expired entries in the background
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		entries: map[string]memoryEntry{},
+		stop:    newStopper(),
+	}
+	go s.stop.every(cleanupInterval, s.cleanup)
+	return s
+}
+
+// Put implements Store
+func (s *MemoryStore) Put(id string, data []byte, ttl time.Duration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.deleteUnlocked(id)
+	s.entries[id] = memoryEntry{
+		data:    data,
+		expires: time.Now().Add(ttl),
+	}
+	s.bytes += int64(len(data))
+	return nil
+}
+
+// Get implements Store
+func (s *MemoryStore) Get(id string) ([]byte, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	entry, ok := s.entries[id]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, ErrNotFound
+	}
+	return entry.data, nil
+}
+
+// Delete implements Store
+func (s *MemoryStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.deleteUnlocked(id)
+	return nil
+}
+
+func (s *MemoryStore) deleteUnlocked(id string) {
+	entry, ok := s.entries[id]
+	if !ok {
+		return
+	}
+	s.bytes -= int64(len(entry.data))
+	delete(s.entries, id)
+}
+
+// expire implements expirer
+func (s *MemoryStore) expire(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.entries[id]; ok {
+		s.deleteUnlocked(id)
+		s.expired++
+	}
+	return nil
+}
+
+// Stats implements Store
+func (s *MemoryStore) Stats() StoreStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return StoreStats{
+		Entries: len(s.entries),
+		Bytes:   s.bytes,
+		Expired: s.expired,
+	}
+}
+
+// Close stops removing the expired entries, the entries that are left stay in memory until the store is garbage collected
+func (s *MemoryStore) Close() error {
+	s.stop.close()
+	return nil
+}
+
+// cleanup removes the expired entries
+func (s *MemoryStore) cleanup() {
+	now := time.Now()
+	s.lock.Lock()
+	for id, entry := range s.entries {
+		if now.After(entry.expires) {
+			s.deleteUnlocked(id)
+			s.expired++
+		}
+	}
+	s.lock.Unlock()
+}
+
+// diskFileExt is the extension of the files created by DiskStore
+const diskFileExt = ".payload"
+
+// diskTempExt is the extension of the files DiskStore writes to before they become an entry
+const diskTempExt = ".tmp"
+
+type diskEntry struct {
+	size    int64
+	expires time.Time
+}
+
+// DiskStore is a Store that writes every entry to a file inside a directory
+// Only the ids and expire times are kept in memory
+type DiskStore struct {
+	dir     string
+	lock    sync.RWMutex
+	entries map[string]diskEntry
+	bytes   int64
+	expired uint64
+	stop    *stopper
+}
+
+// NewDiskStore creates a store that saves entries inside dir
+// If dir doesn't exist it will be created
+// Entries left over from a previous DiskStore in the same dir are removed
+// Call Close when the store is no longer used to stop removing the expired entries in the background
+func NewDiskStore(dir string) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() && (strings.HasSuffix(file.Name(), diskFileExt) || strings.HasSuffix(file.Name(), diskTempExt)) {
+			os.Remove(filepath.Join(dir, file.Name()))
+		}
+	}
+
+	s := &DiskStore{
+		dir:     dir,
+		entries: map[string]diskEntry{},
+		stop:    newStopper(),
+	}
+	go s.stop.every(cleanupInterval, s.cleanup)
+	return s, nil
+}
+
+// path returns the file location of an entry
+// The id is hashed so a id can never point to a file outside of the store dir
+func (s *DiskStore) path(id string) string {
+	return filepath.Join(s.dir, src.Hash(id)+diskFileExt)
+}
+
+// Put implements Store
+// The data is written to a temporary file without holding the lock so large entries don't block the other calls
+func (s *DiskStore) Put(id string, data []byte, ttl time.Duration) error {
+	file, err := ioutil.TempFile(s.dir, "*"+diskTempExt)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err = os.Rename(file.Name(), s.path(id))
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	if entry, ok := s.entries[id]; ok {
+		s.bytes -= entry.size
+	}
+	s.entries[id] = diskEntry{
+		size:    int64(len(data)),
+		expires: time.Now().Add(ttl),
+	}
+	s.bytes += int64(len(data))
+	return nil
+}
+
+// Get implements Store
+func (s *DiskStore) Get(id string) ([]byte, error) {
+	s.lock.RLock()
+	entry, ok := s.entries[id]
+	s.lock.RUnlock()
+
+	if !ok || time.Now().After(entry.expires) {
+		return nil, ErrNotFound
+	}
+	data, err := ioutil.ReadFile(s.path(id))
+	if os.IsNotExist(err) {
+		// The entry was deleted while the file was read
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Delete implements Store
+func (s *DiskStore) Delete(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.deleteUnlocked(id)
+}
+
+func (s *DiskStore) deleteUnlocked(id string) error {
+	entry, ok := s.entries[id]
+	if !ok {
+		return nil
+	}
+	s.bytes -= entry.size
+	delete(s.entries, id)
+
+	err := os.Remove(s.path(id))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// expire implements expirer
+func (s *DiskStore) expire(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.entries[id]; !ok {
+		return nil
+	}
+	s.expired++
+	return s.deleteUnlocked(id)
+}
+
+// Stats implements Store
+func (s *DiskStore) Stats() StoreStats {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return StoreStats{
+		Entries: len(s.entries),
+		Bytes:   s.bytes,
+		Expired: s.expired,
+	}
+}
+
+// Close stops removing the expired entries, the files that are left are removed by the next DiskStore in the same dir
+func (s *DiskStore) Close() error {
+	s.stop.close()
+	return nil
+}
+
+// cleanup removes the expired entries
+func (s *DiskStore) cleanup() {
+	now := time.Now()
+	s.lock.Lock()
+	for id, entry := range s.entries {
+		if now.After(entry.expires) {
+			s.deleteUnlocked(id)
+			s.expired++
+		}
+	}
+	s.lock.Unlock()
+}
+
+// stopper stops the background work of a store
+type stopper struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newStopper() *stopper {
+	return &stopper{done: make(chan struct{})}
+}
+
+// every calls fn every interval until close is called
+func (s *stopper) every(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// close stops every, it's safe to call multiple times
+func (s *stopper) close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
@@ -0,0 +1,64 @@
+package talkserver
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	disk, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]interface {
+		Store
+		Close() error
+	}{
+		"memory": NewMemoryStore(),
+		"disk":   disk,
+	}
+
+	for name, store := range stores {
+		err := store.Put("a", []byte("payload"), time.Minute)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		err = store.Put("b", []byte("expires"), time.Millisecond)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		data, err := store.Get("a")
+		if err != nil || string(data) != "payload" {
+			t.Errorf("%s: expected payload, got %q %v", name, data, err)
+		}
+		time.Sleep(time.Millisecond * 5)
+		if _, err := store.Get("b"); err != ErrNotFound {
+			t.Errorf("%s: expected the expired entry to be gone, got %v", name, err)
+		}
+		if stats := store.Stats(); stats.Bytes != int64(len("payload")+len("expires")) {
+			t.Errorf("%s: expected the expired entry to count until the cleanup, got %d bytes", name, stats.Bytes)
+		}
+
+		store.Delete("a")
+		if _, err := store.Get("a"); err != ErrNotFound {
+			t.Errorf("%s: expected the deleted entry to be gone, got %v", name, err)
+		}
+
+		store.Close()
+		store.Close()
+	}
+
+	files, err := ioutil.ReadDir(disk.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != filepath.Base(disk.path("b")) {
+			t.Errorf("unexpected file %s left in the store dir", file.Name())
+		}
+	}
+}
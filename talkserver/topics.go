@@ -0,0 +1,260 @@
+package talkserver
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mjarkk/socket-talk/src"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// topicKey identifies a subscription
+// If group is set only one session of the group receives a message
+type topicKey struct {
+	title string
+	group string
+}
+
+// subscriberList contains the sessions subscribed to a topicKey
+type subscriberList struct {
+	next     uint64 // The next session of a group that gets a message, first so it's aligned for sync/atomic on 32 bit platforms
+	sessions []*melody.Session
+	locals   int // The amount of sessions that are not another node of the cluster, see isNode
+}
+
+// delivery is a session that should receive a message
+// group is set when the session was chosen as member of a queue group
+type delivery struct {
+	session *melody.Session
+	group   string
+}
+
+// topics keeps track of what sessions are subscribed to what hashed titles
+// A title can contain wildcards, see src.MatchTitle
+type topics struct {
+	lock        sync.RWMutex
+	subscribers map[string]map[string]*subscriberList // The subscribers by title and group
+	sessions    map[*melody.Session]map[topicKey]struct{}
+	wildcards   map[string]struct{} // All titles in subscribers that have a wildcard
+}
+
+func newTopics() *topics {
+	return &topics{
+		subscribers: map[string]map[string]*subscriberList{},
+		sessions:    map[*melody.Session]map[topicKey]struct{}{},
+		wildcards:   map[string]struct{}{},
+	}
+}
+
+// subscribe adds a subscription to key for s
+// Returns true if no session other than the nodes of the cluster was subscribed to this key before
+func (t *topics) subscribe(s *melody.Session, key topicKey) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	groups, ok := t.subscribers[key.title]
+	if !ok {
+		groups = map[string]*subscriberList{}
+		t.subscribers[key.title] = groups
+		if src.HasWildcard(key.title) {
+			t.wildcards[key.title] = struct{}{}
+		}
+	}
+	list, ok := groups[key.group]
+	if !ok {
+		list = &subscriberList{}
+		groups[key.group] = list
+	}
+
+	sessionKeys, ok := t.sessions[s]
+	if !ok {
+		sessionKeys = map[topicKey]struct{}{}
+		t.sessions[s] = sessionKeys
+	}
+	if _, ok := sessionKeys[key]; ok {
+		return false
+	}
+	sessionKeys[key] = struct{}{}
+	list.sessions = append(list.sessions, s)
+
+	if isNode(s) {
+		return false
+	}
+	list.locals++
+	return list.locals == 1
+}
+
+// unsubscribe removes the subscription to key for s
+// Returns true if no session other than the nodes of the cluster is subscribed to this key anymore
+func (t *topics) unsubscribe(s *melody.Session, key topicKey) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.unsubscribeUnlocked(s, key)
+}
+
+func (t *topics) unsubscribeUnlocked(s *melody.Session, key topicKey) bool {
+	sessionKeys, ok := t.sessions[s]
+	if !ok {
+		return false
+	}
+	if _, ok := sessionKeys[key]; !ok {
+		return false
+	}
+	delete(sessionKeys, key)
+	if len(sessionKeys) == 0 {
+		delete(t.sessions, s)
+	}
+
+	groups := t.subscribers[key.title]
+	list := groups[key.group]
+	for i, item := range list.sessions {
+		if item == s {
+			list.sessions = append(list.sessions[:i], list.sessions[i+1:]...)
+			break
+		}
+	}
+
+	node := isNode(s)
+	if !node {
+		list.locals--
+	}
+
+	if len(list.sessions) == 0 {
+		delete(groups, key.group)
+	}
+	if len(groups) == 0 {
+		delete(t.subscribers, key.title)
+		delete(t.wildcards, key.title)
+	}
+	return !node && list.locals == 0
+}
+
+// remove removes all subscriptions of s
+// Returns the keys no session other than the nodes of the cluster is subscribed to anymore
+func (t *topics) remove(s *melody.Session) []topicKey {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	emptied := []topicKey{}
+	for key := range t.sessions[s] {
+		if t.unsubscribeUnlocked(s, key) {
+			emptied = append(emptied, key)
+		}
+	}
+	return emptied
+}
+
+// deliveries returns the sessions that should receive a message with title
+// All sessions subscribed without a group receive the message
+// and of every group that is subscribed one session is chosen round robin,
+// a group that is subscribed to multiple titles that match title still gets the message once
+// If only is not nil only the subscriptions with that group are used
+// The session from is never included and if skipNodes is true the sessions of other nodes of the cluster neither
+func (t *topics) deliveries(title string, only *string, from *melody.Session, skipNodes bool) []delivery {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	titles := []string{}
+	if _, ok := t.subscribers[title]; ok {
+		titles = append(titles, title)
+	}
+	for pattern := range t.wildcards {
+		if pattern != title && src.MatchTitle(pattern, title) {
+			titles = append(titles, pattern)
+		}
+	}
+	// Always merge the lists of a group in the same order so the group keeps taking turns
+	sort.Strings(titles)
+
+	toReturn := []delivery{}
+	unique := map[*melody.Session]struct{}{}
+	groups := map[string][]*subscriberList{}
+	groupOrder := []string{}
+	for _, matched := range titles {
+		for group, list := range t.subscribers[matched] {
+			if only != nil && group != *only {
+				continue
+			}
+			if group != "" {
+				if _, ok := groups[group]; !ok {
+					groupOrder = append(groupOrder, group)
+				}
+				groups[group] = append(groups[group], list)
+				continue
+			}
+
+			for _, s := range list.sessions {
+				if _, ok := unique[s]; ok || s == from || (skipNodes && isNode(s)) {
+					continue
+				}
+				unique[s] = struct{}{}
+				toReturn = append(toReturn, delivery{s, ""})
+			}
+		}
+	}
+
+	for _, group := range groupOrder {
+		if s := pickMember(groups[group], from, skipNodes); s != nil {
+			toReturn = append(toReturn, delivery{s, group})
+		}
+	}
+	return toReturn
+}
+
+// pickMember chooses the next session of a queue group that is subscribed with lists
+// If the group is subscribed to multiple matching titles the members are merged and the counter of the first list is used
+func pickMember(lists []*subscriberList, skip *melody.Session, skipNodes bool) *melody.Session {
+	if len(lists) == 1 {
+		return lists[0].pick(skip, skipNodes)
+	}
+
+	members := []*melody.Session{}
+	unique := map[*melody.Session]struct{}{}
+	for _, list := range lists {
+		for _, s := range list.sessions {
+			if _, ok := unique[s]; ok {
+				continue
+			}
+			unique[s] = struct{}{}
+			members = append(members, s)
+		}
+	}
+	return pickFrom(&lists[0].next, members, skip, skipNodes)
+}
+
+// pick chooses the next session of a queue group that is not skip
+// If skipNodes is true the sessions of other nodes of the cluster are not chosen
+// It only needs the read lock of topics as next is changed with sync/atomic
+func (l *subscriberList) pick(skip *melody.Session, skipNodes bool) *melody.Session {
+	return pickFrom(&l.next, l.sessions, skip, skipNodes)
+}
+
+// pickFrom chooses the session of sessions next points to that is not skip and moves next forward
+func pickFrom(next *uint64, sessions []*melody.Session, skip *melody.Session, skipNodes bool) *melody.Session {
+	for range sessions {
+		i := atomic.AddUint64(next, 1) - 1
+		s := sessions[i%uint64(len(sessions))]
+		if s != skip && (!skipNodes || !isNode(s)) {
+			return s
+		}
+	}
+	return nil
+}
+
+// list returns all keys that have at least one subscriber that is not another node of the cluster
+func (t *topics) list() []topicKey {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	toReturn := make([]topicKey, 0, len(t.subscribers))
+	for title, groups := range t.subscribers {
+		for group, list := range groups {
+			if list.locals > 0 {
+				toReturn = append(toReturn, topicKey{title, group})
+			}
+		}
+	}
+	return toReturn
+}
@@ -0,0 +1,104 @@
+package talkserver
+
+import (
+	"testing"
+
+	"github.com/mjarkk/socket-talk/src"
+	"gopkg.in/olahol/melody.v1"
+)
+
+func TestTopicsDeliveries(t *testing.T) {
+	exact := &melody.Session{}
+	wildcard := &melody.Session{}
+	other := &melody.Session{}
+	workerA := &melody.Session{}
+	workerB := &melody.Session{}
+	node := &melody.Session{Keys: map[string]interface{}{nodeKey: "node-1"}}
+
+	topics := newTopics()
+	topics.subscribe(exact, topicKey{src.HashTitle("orders.created"), ""})
+	topics.subscribe(wildcard, topicKey{src.HashTitle("orders.*"), ""})
+	topics.subscribe(wildcard, topicKey{src.HashTitle("orders.>"), ""})
+	topics.subscribe(other, topicKey{src.HashTitle("invoices.created"), ""})
+	topics.subscribe(workerA, topicKey{src.HashTitle("orders.created"), "workers"})
+	topics.subscribe(workerB, topicKey{src.HashTitle("orders.created"), "workers"})
+	topics.subscribe(node, topicKey{src.HashTitle("orders.created"), ""})
+
+	count := func(deliveries []delivery) map[*melody.Session]int {
+		toReturn := map[*melody.Session]int{}
+		for _, d := range deliveries {
+			toReturn[d.session]++
+		}
+		return toReturn
+	}
+
+	title := src.HashTitle("orders.created")
+	workers := map[*melody.Session]int{}
+	for i := 0; i < 4; i++ {
+		got := count(topics.deliveries(title, nil, nil, true))
+		if got[exact] != 1 || got[wildcard] != 1 || got[other] != 0 || got[node] != 0 {
+			t.Fatalf("wrong deliveries %v", got)
+		}
+		if got[workerA]+got[workerB] != 1 {
+			t.Fatalf("expected one worker to receive the message, got %v", got)
+		}
+		workers[workerA] += got[workerA]
+		workers[workerB] += got[workerB]
+	}
+	if workers[workerA] != 2 || workers[workerB] != 2 {
+		t.Errorf("expected the workers to take turns, got %v", workers)
+	}
+
+	got := count(topics.deliveries(title, nil, exact, false))
+	if got[exact] != 0 || got[node] != 1 {
+		t.Errorf("expected the sender to be skipped and the node to be included, got %v", got)
+	}
+
+	only := "workers"
+	got = count(topics.deliveries(title, &only, nil, true))
+	if len(got) != 1 || got[workerA]+got[workerB] != 1 {
+		t.Errorf("expected only a worker, got %v", got)
+	}
+
+	got = count(topics.deliveries(src.HashTitle("orders.created.eu"), nil, nil, true))
+	if len(got) != 1 || got[wildcard] != 1 {
+		t.Errorf("expected only the multi level wildcard, got %v", got)
+	}
+
+	topics.unsubscribe(exact, topicKey{src.HashTitle("orders.created"), ""})
+	topics.remove(wildcard)
+	got = count(topics.deliveries(title, nil, nil, true))
+	if got[exact] != 0 || got[wildcard] != 0 {
+		t.Errorf("expected the removed subscriptions to be gone, got %v", got)
+	}
+	if len(topics.wildcards) != 0 {
+		t.Errorf("expected no wildcards left, got %v", topics.wildcards)
+	}
+}
+
+func TestTopicsDeliveriesGroupOnMultipleTitles(t *testing.T) {
+	wildcard := &melody.Session{}
+	exact := &melody.Session{}
+
+	topics := newTopics()
+	topics.subscribe(wildcard, topicKey{src.HashTitle("orders.*"), "workers"})
+	topics.subscribe(exact, topicKey{src.HashTitle("orders.created"), "workers"})
+
+	title := src.HashTitle("orders.created")
+	received := map[*melody.Session]int{}
+	for i := 0; i < 4; i++ {
+		deliveries := topics.deliveries(title, nil, nil, true)
+		if len(deliveries) != 1 {
+			t.Fatalf("expected the group to receive the message once, got %d deliveries", len(deliveries))
+		}
+		received[deliveries[0].session]++
+	}
+	if received[wildcard] != 2 || received[exact] != 2 {
+		t.Errorf("expected the members to take turns, got %v", received)
+	}
+
+	got := topics.deliveries(src.HashTitle("orders.deleted"), nil, nil, true)
+	if len(got) != 1 || got[0].session != wildcard {
+		t.Errorf("expected only the wildcard member, got %v", got)
+	}
+}
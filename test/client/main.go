@@ -27,20 +27,23 @@ func main() {
 func setupClient() {
 	c, err := talkclient.NewClient(talkclient.Options{
 		ServerURL: "http://localhost:9090",
+		OnStateChange: func(state talkclient.State, err error) {
+			if err != nil {
+				fmt.Println("ERROR:", err)
+			}
+			fmt.Println("Connection state:", state)
+		},
 	})
 	if err != nil {
 		fmt.Println("ERROR:", err)
 		os.Exit(1)
 	}
 
-	go func() {
-		for {
-			err := c.Connect()
-			fmt.Println("ERROR:", err)
-			fmt.Println("Reconnecting in 3 seconds")
-			time.Sleep(time.Second * 3)
-		}
-	}()
+	err = c.Start()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		os.Exit(1)
+	}
 
 	<-c.ConnectChan
 	c.Subscribe("test", func(msg *talkclient.WSMessage) {